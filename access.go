@@ -0,0 +1,295 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBurst           = 10
+	defaultDropLogInterval = time.Minute
+
+	dropDenied      = "denied"
+	dropRateLimited = "rate_limited"
+)
+
+var (
+	ErrInvalidCIDR  = errors.New("invalid CIDR")
+	ErrSourceDenied = errors.New("source not allowed")
+	ErrRateLimited  = errors.New("rate limit exceeded")
+)
+
+// parseCIDRs parses a comma-separated list of CIDRs; bare IP addresses are
+// treated as a network containing only that address.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidCIDR, cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidCIDR, cidr)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessConfig configures which sources may send events, and how often. A nil
+// Allow list allows all sources not in the Deny list, and a zero Rate disables
+// rate limiting.
+type accessConfig struct {
+	Allow, Deny []*net.IPNet
+
+	// Rate is the number of connections, datagrams or requests per second
+	// allowed from each source IP, with up to Burst allowed at once.
+	Rate  float64
+	Burst int
+
+	// DropLogInterval is how often a summary of dropped connections is logged.
+	DropLogInterval time.Duration
+}
+
+func (c accessConfig) withDefaults() accessConfig {
+	if c.Burst <= 0 {
+		c.Burst = defaultBurst
+	}
+
+	if c.DropLogInterval <= 0 {
+		c.DropLogInterval = defaultDropLogInterval
+	}
+
+	return c
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// accessControl checks sources against the allow and deny lists and a token
+// bucket per source IP, counting those it drops.
+type accessControl struct {
+	config  accessConfig
+	metrics *metrics
+	now     func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	dropped map[string]map[string]int
+	done    chan struct{}
+}
+
+func newAccessControl(config accessConfig, m *metrics) *accessControl {
+	a := &accessControl{
+		config:  config.withDefaults(),
+		metrics: m,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+		dropped: make(map[string]map[string]int),
+		done:    make(chan struct{}),
+	}
+
+	go a.run()
+
+	return a
+}
+
+// allow returns nil if an event source with the given IP should be accepted,
+// otherwise counting it as dropped and returning ErrSourceDenied or
+// ErrRateLimited.
+func (a *accessControl) allow(ip string) error {
+	err := a.check(ip)
+	if err == nil {
+		return nil
+	}
+
+	reason := dropDenied
+	if errors.Is(err, ErrRateLimited) {
+		reason = dropRateLimited
+	}
+
+	a.metrics.dropped.WithLabelValues(reason).Inc()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.dropped[reason] == nil {
+		a.dropped[reason] = make(map[string]int)
+	}
+
+	a.dropped[reason][ip]++
+
+	return err
+}
+
+func (a *accessControl) check(ip string) error {
+	parsed := net.ParseIP(ip)
+
+	if parsed != nil && containsIP(a.config.Deny, parsed) ||
+		len(a.config.Allow) > 0 && (parsed == nil || !containsIP(a.config.Allow, parsed)) {
+		return fmt.Errorf("%w: %s", ErrSourceDenied, ip)
+	}
+
+	if a.config.Rate > 0 && !a.take(ip) {
+		return fmt.Errorf("%w: %s", ErrRateLimited, ip)
+	}
+
+	return nil
+}
+
+// take removes a token from the bucket for the given IP, returning false if
+// there are none.
+func (a *accessControl) take(ip string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+
+	b, ok := a.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(a.config.Burst)}
+		a.buckets[ip] = b
+	} else {
+		b.tokens = min(float64(a.config.Burst), b.tokens+now.Sub(b.last).Seconds()*a.config.Rate)
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func (a *accessControl) run() {
+	ticker := time.NewTicker(a.config.DropLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.logDropped()
+			a.pruneBuckets()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// logDropped logs, for each reason, the number of sources dropped since the
+// last summary, along with the source dropped most often.
+func (a *accessControl) logDropped() {
+	a.mu.Lock()
+	dropped := a.dropped
+	a.dropped = make(map[string]map[string]int)
+	a.mu.Unlock()
+
+	for reason, sources := range dropped {
+		var total, top int
+
+		topIP := ""
+
+		for ip, count := range sources {
+			total += count
+
+			if count > top || count == top && ip < topIP {
+				top, topIP = count, ip
+			}
+		}
+
+		slog.Warn("dropped connections", "reason", reason, "count", total,
+			"sources", len(sources), "top_source", topIP, "top_count", top)
+	}
+}
+
+// pruneBuckets removes the buckets that have refilled, which are no different
+// from new ones.
+func (a *accessControl) pruneBuckets() {
+	if a.config.Rate <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+
+	for ip, b := range a.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*a.config.Rate >= float64(a.config.Burst) {
+			delete(a.buckets, ip)
+		}
+	}
+}
+
+// Close stops the periodic summaries, logging a final one.
+func (a *accessControl) Close() {
+	close(a.done)
+	a.logDropped()
+}
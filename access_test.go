@@ -0,0 +1,132 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	for n, test := range [...]struct {
+		Input    string
+		Expected []string
+		Error    bool
+	}{
+		{Input: ""},
+		{Input: "10.0.0.0/8, 192.168.1.1 ,,::1", Expected: []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128"}},
+		{Input: "10.1.2.3/16", Expected: []string{"10.1.0.0/16"}},
+		{Input: "10.0.0.0/33", Error: true},
+		{Input: "not-an-ip", Error: true},
+	} {
+		networks, err := parseCIDRs(test.Input)
+		if test.Error {
+			if !errors.Is(err, ErrInvalidCIDR) {
+				t.Errorf("test %d: expecting invalid CIDR error, got %v", n+1, err)
+			}
+
+			continue
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if len(networks) != len(test.Expected) {
+			t.Errorf("test %d: expecting %d networks, got %d", n+1, len(test.Expected), len(networks))
+
+			continue
+		}
+
+		for m, network := range networks {
+			if network.String() != test.Expected[m] {
+				t.Errorf("test %d.%d: expecting network %s, got %s", n+1, m+1, test.Expected[m], network)
+			}
+		}
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	allow, err := parseCIDRs("10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatalf("unexpected error parsing CIDRs: %s", err)
+	}
+
+	deny, err := parseCIDRs("10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error parsing CIDRs: %s", err)
+	}
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	a := newAccessControl(accessConfig{Allow: allow, Deny: deny, Rate: 1, Burst: 2}, newMetrics(db))
+	defer a.Close()
+
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+
+	for n, test := range [...]struct {
+		IP      string
+		Advance time.Duration
+		Error   error
+	}{
+		{IP: "10.0.0.2"},
+		{IP: "::1"},
+		{IP: "10.0.0.1", Error: ErrSourceDenied},
+		{IP: "192.168.0.1", Error: ErrSourceDenied},
+		{IP: "unix", Error: ErrSourceDenied},
+		{IP: "10.0.0.2"},
+		{IP: "10.0.0.2", Error: ErrRateLimited},
+		{IP: "10.0.0.3"},
+		{IP: "10.0.0.2", Advance: 500 * time.Millisecond, Error: ErrRateLimited},
+		{IP: "10.0.0.2", Advance: 500 * time.Millisecond},
+		{IP: "10.0.0.2", Error: ErrRateLimited},
+		{IP: "10.0.0.2", Advance: time.Hour},
+		{IP: "10.0.0.2"},
+		{IP: "10.0.0.2", Error: ErrRateLimited},
+	} {
+		now = now.Add(test.Advance)
+
+		if err := a.allow(test.IP); !errors.Is(err, test.Error) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Error, err)
+		}
+	}
+
+	if dropped := a.dropped[dropRateLimited]["10.0.0.2"]; dropped != 4 {
+		t.Errorf("expecting 4 rate limited drops for 10.0.0.2, got %d", dropped)
+	}
+
+	a.pruneBuckets()
+
+	if _, ok := a.buckets["10.0.0.2"]; !ok || len(a.buckets) != 1 {
+		t.Errorf("expecting only the bucket for 10.0.0.2 after pruning, got %d buckets", len(a.buckets))
+	}
+}
@@ -0,0 +1,325 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package analytics
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long the client waits to connect to and send to
+	// the server when no timeout is configured.
+	DefaultTimeout = 2 * time.Second
+
+	// DefaultQueueSize is the number of events that Send will hold while
+	// they wait to be sent, when no queue size is configured.
+	DefaultQueueSize = 100
+
+	// DefaultMaxFlush is the number of spooled events sent along with each new
+	// event, when no limit is configured.
+	DefaultMaxFlush = 50
+)
+
+var (
+	ErrClosed  = errors.New("client closed")
+	ErrSpooled = errors.New("event spooled")
+)
+
+// Config configures a Client.
+type Config struct {
+	// Network is the network of the server: tcp (the default), udp or unix.
+	Network string
+
+	// Addr is the address of the server, e.g. host:1234, or the path of its
+	// Unix socket.
+	Addr string
+
+	// Timeout limits how long connecting to and sending to the server may
+	// take; it defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// TLS, if not nil, is used to connect to a server listening with TLS.
+	TLS *tls.Config
+
+	// Legacy sends only the username and command, in the format understood by
+	// all versions of the server.
+	Legacy bool
+
+	// KeyID and Secret, if given, are used to sign extended payloads.
+	KeyID  string
+	Secret []byte
+
+	// SpoolDir, if given, is where events that could not be sent are stored,
+	// to be sent along with the next event that is. It may be shared by many
+	// clients, in many processes, each spooled event being sent by only one.
+	SpoolDir string
+
+	// MaxFlush is the maximum number of spooled events sent along with each new
+	// event; it defaults to DefaultMaxFlush.
+	MaxFlush int
+
+	// QueueSize is the number of events Send will hold while they wait to be
+	// sent; it defaults to DefaultQueueSize.
+	QueueSize int
+}
+
+// Client sends events to the analytics server.
+type Client struct {
+	config Config
+
+	mu     sync.Mutex
+	queue  chan Payload
+	closed bool
+	done   chan struct{}
+}
+
+// NewClient returns a client that sends events to the configured server.
+func NewClient(config Config) *Client {
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+
+	if config.MaxFlush <= 0 {
+		config.MaxFlush = DefaultMaxFlush
+	}
+
+	c := &Client{
+		config: config,
+		queue:  make(chan Payload, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Send queues the event to be sent in the background, without ever blocking or
+// returning an error; if the queue is full or the client is closed, the event
+// is dropped.
+func (c *Client) Send(p Payload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.queue <- c.withTime(p):
+	default:
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+
+	for p := range c.queue {
+		c.SendSync(p) //nolint:errcheck
+	}
+}
+
+// SendSync sends the event, along with up to MaxFlush events from the spool,
+// returning once they have been sent or the timeout has passed. If the event
+// could not be sent, it is spooled, when a spool directory is configured, and
+// the returned error wraps ErrSpooled.
+func (c *Client) SendSync(p Payload) error {
+	p = c.withTime(p)
+
+	record, err := c.encode(p)
+	if err != nil {
+		return err
+	}
+
+	claims := c.claimSpooled()
+	records := make([]string, 0, len(claims)+1)
+
+	for _, cl := range claims {
+		records = append(records, cl.record)
+	}
+
+	sent := 0
+
+	err = c.send(append(records, record), func(n int) {
+		if n < len(claims) {
+			os.Remove(claims[n].path)
+		}
+
+		sent = n + 1
+	})
+
+	for _, cl := range claims[min(sent, len(claims)):] {
+		cl.release()
+	}
+
+	if err == nil || sent > len(claims) {
+		return nil
+	} else if c.config.SpoolDir == "" {
+		return err
+	}
+
+	if serr := c.spool(record); serr != nil {
+		return errors.Join(err, serr)
+	}
+
+	return fmt.Errorf("%w: %w", ErrSpooled, err)
+}
+
+// withTime sets the time of the event to now, if not set, so that it is not
+// lost if the event is spooled. Legacy payloads cannot contain a time.
+func (c *Client) withTime(p Payload) Payload {
+	if p.Time == 0 && !c.config.Legacy {
+		p.Time = time.Now().Unix()
+	}
+
+	return p
+}
+
+func (c *Client) encode(p Payload) (string, error) {
+	if c.config.Legacy {
+		return p.EncodeLegacy()
+	}
+
+	record, err := p.Encode()
+	if err != nil || c.config.KeyID == "" {
+		return record, err
+	}
+
+	return SignPayload(record, c.config.KeyID, c.config.Secret), nil
+}
+
+// send sends the records, in a single connection where the protocol allows,
+// calling delivered with the index of each record once it has been written.
+func (c *Client) send(records []string, delivered func(int)) error {
+	if c.config.Legacy || c.config.Network == "udp" {
+		for n, record := range records {
+			if err := c.sendConn(record); err != nil {
+				return err
+			}
+
+			delivered(n)
+		}
+
+		return nil
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	for n, record := range records {
+		if n > 0 {
+			record = string(RecordSeparator) + record
+		}
+
+		if _, err := conn.Write([]byte(record)); err != nil {
+			conn.Close()
+
+			return err
+		}
+
+		delivered(n)
+	}
+
+	return conn.Close()
+}
+
+func (c *Client) sendConn(data string) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write([]byte(data)); err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	return conn.Close()
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.config.Timeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if c.config.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, c.config.Network, c.config.Addr, c.config.TLS)
+	} else {
+		conn, err = dialer.Dial(c.config.Network, c.config.Addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(c.config.Timeout)) //nolint:errcheck
+
+	return conn, nil
+}
+
+// Close stops accepting events, waiting up to the timeout for those queued by
+// Send to be sent.
+func (c *Client) Close() error {
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+
+		return ErrClosed
+	}
+
+	c.closed = true
+	close(c.queue)
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+	case <-time.After(c.config.Timeout):
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package analytics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	p := Payload{
+		Username: "USER",
+		Command:  "/path/to/command",
+		Hostname: "node1",
+		JobID:    "123",
+		Time:     1700000000,
+	}
+
+	record, err := p.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error encoding payload: %s", err)
+	}
+
+	if parsed, err := ParsePayload(record); err != nil {
+		t.Errorf("unexpected error parsing payload: %s", err)
+	} else if parsed != p {
+		t.Errorf("expecting payload %+v, got %+v", p, parsed)
+	}
+
+	if record, err = p.EncodeLegacy(); err != nil {
+		t.Errorf("unexpected error encoding legacy payload: %s", err)
+	} else if record != "USER\x00/path/to/command" {
+		t.Errorf("expecting legacy payload, got %q", record)
+	}
+
+	signed := SignPayload("SPA1\x00user=USER\x00command=/path", "key", []byte("secret"))
+	if !strings.HasPrefix(signed, "SPA1\x00user=USER\x00command=/path\x00sig=key:") {
+		t.Errorf("expecting signature field to be appended, got %q", signed)
+	}
+
+	for n, p := range [...]Payload{
+		{Username: "USER"},
+		{Username: "USER", Command: "/path\x00"},
+		{Username: "USER", Command: "/path", Cwd: "\x1e"},
+		{Username: "USER", Command: strings.Repeat("a", MaxPayloadSize)},
+	} {
+		if _, err := p.Encode(); err == nil {
+			t.Errorf("test %d: expecting error encoding %+v", n+1, p)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	l, records := newTestServer(t)
+	spoolDir := t.TempDir()
+
+	dead := NewClient(Config{Addr: deadAddr(t), SpoolDir: spoolDir, Timeout: 100 * time.Millisecond})
+	defer dead.Close()
+
+	if err := dead.SendSync(Payload{Username: "USER_A", Command: "/path/a", Time: 1700000000}); !errors.Is(err, ErrSpooled) {
+		t.Fatalf("expecting spooled error sending to closed port, got %v", err)
+	}
+
+	if paths, _ := filepath.Glob(filepath.Join(spoolDir, "*"+spoolExt)); len(paths) != 1 { //nolint:errcheck
+		t.Fatalf("expecting 1 spooled event, got %d", len(paths))
+	}
+
+	c := NewClient(Config{Addr: l.Addr().String(), SpoolDir: spoolDir})
+
+	if err := c.SendSync(Payload{Username: "USER_B", Command: "/path/b", Hostname: "node1"}); err != nil {
+		t.Fatalf("unexpected error sending event: %s", err)
+	}
+
+	c.Send(Payload{Username: "USER_C", Command: "/path/c"})
+	c.Close()
+
+	for n, expected := range [...]Payload{
+		{Username: "USER_A", Command: "/path/a", Time: 1700000000},
+		{Username: "USER_B", Command: "/path/b", Hostname: "node1"},
+		{Username: "USER_C", Command: "/path/c"},
+	} {
+		select {
+		case p := <-records:
+			if expected.Time == 0 && time.Since(time.Unix(p.Time, 0)) < time.Minute {
+				expected.Time = p.Time
+			}
+
+			if p != expected {
+				t.Errorf("event %d: expecting %+v, got %+v", n+1, expected, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expecting event %d to be received", n+1)
+		}
+	}
+
+	if paths, _ := filepath.Glob(filepath.Join(spoolDir, "*"+spoolExt)); len(paths) != 0 { //nolint:errcheck
+		t.Errorf("expecting spool to be empty, got %d events", len(paths))
+	}
+}
+
+func TestClientSharedSpool(t *testing.T) {
+	l, records := newTestServer(t)
+	spoolDir := t.TempDir()
+
+	dead := NewClient(Config{Addr: deadAddr(t), SpoolDir: spoolDir, Timeout: 100 * time.Millisecond})
+	defer dead.Close()
+
+	for n := 0; n < 10; n++ {
+		if err := dead.SendSync(Payload{Username: fmt.Sprintf("SPOOLED_%d", n), Command: "/path"}); !errors.Is(err, ErrSpooled) {
+			t.Fatalf("test %d: expecting spooled error, got %v", n+1, err)
+		}
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(spoolDir, "*"+spoolExt)) //nolint:errcheck
+	stale := paths[0] + ".old" + claimExt
+	old := time.Now().Add(-2 * staleClaimAge)
+
+	if err := os.Rename(paths[0], stale); err != nil {
+		t.Fatalf("unexpected error claiming spooled event: %s", err)
+	} else if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatalf("unexpected error ageing claim: %s", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+
+		go func(n int) {
+			defer wg.Done()
+
+			c := NewClient(Config{Addr: l.Addr().String(), SpoolDir: spoolDir, MaxFlush: 2})
+			defer c.Close()
+
+			for m := 0; m < 3; m++ {
+				c.SendSync(Payload{Username: fmt.Sprintf("NEW_%d_%d", n, m), Command: "/path"}) //nolint:errcheck
+			}
+		}(n)
+	}
+
+	wg.Wait()
+
+	counts := make(map[string]int)
+
+	for n := 0; n < 22; n++ {
+		select {
+		case p := <-records:
+			counts[p.Username]++
+		case <-time.After(time.Second):
+			t.Fatalf("expecting 22 events, got %d", n)
+		}
+	}
+
+	for username, count := range counts {
+		if count != 1 {
+			t.Errorf("expecting event for %s to be received once, got %d", username, count)
+		}
+	}
+
+	if paths, _ := filepath.Glob(filepath.Join(spoolDir, "*")); len(paths) != 0 { //nolint:errcheck
+		t.Errorf("expecting spool to be empty, got %v", paths)
+	}
+}
+
+func TestClientSendDoesNotBlock(t *testing.T) {
+	c := NewClient(Config{Addr: deadAddr(t), QueueSize: 1, Timeout: 50 * time.Millisecond})
+
+	start := time.Now()
+
+	for i := 0; i < 1000; i++ {
+		c.Send(Payload{Username: "USER", Command: "/path"})
+	}
+
+	c.Close()
+	c.Send(Payload{Username: "USER", Command: "/path"})
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expecting Send and Close to return quickly, took %s", d)
+	}
+}
+
+// newTestServer starts a server that parses the records it receives, sending
+// them on the returned channel.
+func newTestServer(t *testing.T) (net.Listener, chan Payload) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	records := make(chan Payload, 100)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			data, _ := io.ReadAll(c) //nolint:errcheck
+			c.Close()
+
+			for _, record := range strings.Split(string(data), string(RecordSeparator)) {
+				if p, err := ParsePayload(record); err == nil {
+					records <- p
+				}
+			}
+		}
+	}()
+
+	return l, records
+}
+
+// deadAddr returns an address on which nothing is listening.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	addr := l.Addr().String()
+
+	l.Close()
+
+	return addr
+}
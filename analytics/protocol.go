@@ -0,0 +1,231 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+// Package analytics implements the wire format of the SoftPack analytics
+// server, and a client that sends events to it.
+package analytics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProtocolMagic begins each payload in the extended protocol, which is followed
+// by NUL-separated key=value fields.
+const ProtocolMagic = "SPA1"
+
+// RecordSeparator separates extended payloads sent on a single connection.
+const RecordSeparator = '\x1e'
+
+// MaxPayloadSize is the largest payload accepted by the server.
+const MaxPayloadSize = 4096
+
+// FieldSignature is the final field of a signed extended payload, and has the
+// form sig=<keyid>:<hex HMAC-SHA256>, calculated over the payload bytes before
+// the NUL that precedes it.
+const FieldSignature = "sig"
+
+const (
+	fieldUsername = "user"
+	fieldCommand  = "command"
+	fieldHostname = "host"
+	fieldCwd      = "cwd"
+	fieldJobID    = "jobid"
+	fieldVersion  = "version"
+	fieldTime     = "time"
+)
+
+var ErrMalformedPayload = errors.New("malformed payload")
+
+// Payload is a single event as sent by a client.
+type Payload struct {
+	Username string
+	Command  string
+	Hostname string
+	Cwd      string
+	JobID    string
+	Version  string
+	Time     int64
+}
+
+// ParsePayload parses either a legacy payload, which is a username and command
+// separated by a NUL byte, or an extended payload, which is the protocolMagic
+// followed by NUL-separated key=value fields.
+//
+// Extended payloads must contain the user and command fields, and may contain a
+// time field with the Unix time the event occurred; unknown fields are ignored
+// so that older servers can accept payloads from newer clients.
+func ParsePayload(data string) (Payload, error) {
+	parts := strings.Split(data, "\x00")
+
+	if len(parts) > 2 && parts[0] == ProtocolMagic {
+		return parseExtendedPayload(parts[1:])
+	}
+
+	if len(parts) != 2 {
+		return Payload{}, fmt.Errorf("%w: expecting 2 fields, got %d", ErrMalformedPayload, len(parts))
+	}
+
+	return Payload{
+		Username: strings.TrimSpace(parts[0]),
+		Command:  strings.TrimSpace(parts[1]),
+	}, nil
+}
+
+func parseExtendedPayload(fields []string) (Payload, error) {
+	var p Payload
+
+	seen := make(map[string]bool, len(fields))
+
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return p, fmt.Errorf("%w: field %q is not in key=value form", ErrMalformedPayload, field)
+		} else if seen[key] {
+			return p, fmt.Errorf("%w: duplicate field %q", ErrMalformedPayload, key)
+		}
+
+		seen[key] = true
+
+		if key == fieldTime {
+			t, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil || t <= 0 {
+				return p, fmt.Errorf("%w: invalid time %q", ErrMalformedPayload, value)
+			}
+
+			p.Time = t
+		} else if dest := p.field(key); dest != nil {
+			*dest = strings.TrimSpace(value)
+		}
+	}
+
+	if p.Username == "" || p.Command == "" {
+		return p, fmt.Errorf("%w: missing %s or %s field", ErrMalformedPayload, fieldUsername, fieldCommand)
+	}
+
+	return p, nil
+}
+
+func (p *Payload) field(key string) *string {
+	switch key {
+	case fieldUsername:
+		return &p.Username
+	case fieldCommand:
+		return &p.Command
+	case fieldHostname:
+		return &p.Hostname
+	case fieldCwd:
+		return &p.Cwd
+	case fieldJobID:
+		return &p.JobID
+	case fieldVersion:
+		return &p.Version
+	}
+
+	return nil
+}
+
+// Encode returns the payload in the extended protocol, omitting empty fields.
+func (p Payload) Encode() (string, error) {
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString(ProtocolMagic)
+
+	for _, field := range [...]struct{ key, value string }{
+		{fieldUsername, p.Username},
+		{fieldCommand, p.Command},
+		{fieldHostname, p.Hostname},
+		{fieldCwd, p.Cwd},
+		{fieldJobID, p.JobID},
+		{fieldVersion, p.Version},
+	} {
+		if field.value != "" {
+			sb.WriteString("\x00" + field.key + "=" + field.value)
+		}
+	}
+
+	if p.Time > 0 {
+		sb.WriteString("\x00" + fieldTime + "=" + strconv.FormatInt(p.Time, 10))
+	}
+
+	return checkSize(sb.String())
+}
+
+// EncodeLegacy returns the username and command of the payload in the legacy
+// protocol, as understood by all versions of the server.
+func (p Payload) EncodeLegacy() (string, error) {
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+
+	return checkSize(p.Username + "\x00" + p.Command)
+}
+
+func (p Payload) validate() error {
+	if strings.TrimSpace(p.Username) == "" || strings.TrimSpace(p.Command) == "" {
+		return fmt.Errorf("%w: missing username or command", ErrMalformedPayload)
+	}
+
+	for _, field := range [...]string{p.Username, p.Command, p.Hostname, p.Cwd, p.JobID, p.Version} {
+		if strings.ContainsAny(field, "\x00\x1e") {
+			return fmt.Errorf("%w: fields must not contain NUL or record separator", ErrMalformedPayload)
+		}
+	}
+
+	return nil
+}
+
+func checkSize(payload string) (string, error) {
+	if len(payload) > MaxPayloadSize {
+		return "", fmt.Errorf("%w: payload larger than %d bytes", ErrMalformedPayload, MaxPayloadSize)
+	}
+
+	return payload, nil
+}
+
+// SignPayload appends a signature field, using the given key, to an extended
+// payload.
+func SignPayload(payload, keyID string, secret []byte) string {
+	return payload + "\x00" + FieldSignature + "=" + keyID + ":" + hex.EncodeToString(Sign(secret, []byte(payload)))
+}
+
+// Sign returns the HMAC-SHA256 of the given body using the given key.
+func Sign(key, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+
+	mac.Write(body)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,107 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package analytics
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePayload(t *testing.T) {
+	for n, test := range [...]struct {
+		Input    string
+		Expected Payload
+		Error    bool
+	}{
+		{
+			Input:    "USER\x00/path/to/command\n",
+			Expected: Payload{Username: "USER", Command: "/path/to/command"},
+		},
+		{
+			Input: "SPA1\x00user=USER\x00command=/path/to/command\x00host=node1\x00cwd=/home/user\x00jobid=123\x00version=1.2\n",
+			Expected: Payload{
+				Username: "USER",
+				Command:  "/path/to/command",
+				Hostname: "node1",
+				Cwd:      "/home/user",
+				JobID:    "123",
+				Version:  "1.2",
+			},
+		},
+		{
+			Input:    "SPA1\x00command=a=b\x00user=USER\x00future=field",
+			Expected: Payload{Username: "USER", Command: "a=b"},
+		},
+		{
+			Input:    "SPA1\x00user=USER\x00command=/path/to/command\x00time=1700000000",
+			Expected: Payload{Username: "USER", Command: "/path/to/command", Time: 1700000000},
+		},
+		{
+			Input:    "SPA1\x00/path/to/command",
+			Expected: Payload{Username: "SPA1", Command: "/path/to/command"},
+		},
+		{
+			Input: "USER",
+			Error: true,
+		},
+		{
+			Input: "USER\x00command\x00extra",
+			Error: true,
+		},
+		{
+			Input: "SPA1\x00user=USER\x00host=node1",
+			Error: true,
+		},
+		{
+			Input: "SPA1\x00user=USER\x00command=a\x00command=b",
+			Error: true,
+		},
+		{
+			Input: "SPA1\x00user=USER\x00command=a\x00novalue",
+			Error: true,
+		},
+		{
+			Input: "SPA1\x00user=USER\x00command=a\x00time=yesterday",
+			Error: true,
+		},
+		{
+			Input: "SPA1\x00user=USER\x00command=a\x00time=-1",
+			Error: true,
+		},
+	} {
+		p, err := ParsePayload(test.Input)
+		if test.Error {
+			if !errors.Is(err, ErrMalformedPayload) {
+				t.Errorf("test %d: expecting malformed payload error, got %v", n+1, err)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if p != test.Expected {
+			t.Errorf("test %d: expecting payload %+v, got %+v", n+1, test.Expected, p)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package analytics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	spoolExt = ".spa"
+
+	// claimExt ends the name of a spooled event that a client has claimed to
+	// send, which is its original name followed by a token unique to the
+	// claim.
+	claimExt = ".claim"
+
+	// staleClaimAge is how long after it is claimed that a spooled event may
+	// be claimed again, if the client that claimed it did not send or release
+	// it, e.g. because its process was killed.
+	staleClaimAge = 5 * time.Minute
+)
+
+// claim is a spooled event that has been claimed to be sent by this client.
+type claim struct {
+	path, original string
+	record         string
+}
+
+// release returns the claimed event to the spool, to be sent later.
+func (cl claim) release() {
+	os.Rename(cl.path, cl.original) //nolint:errcheck
+}
+
+// claimSpooled claims up to MaxFlush spooled events, oldest first, by renaming
+// them, which only one client can do, so that each event is only sent once by
+// the clients sharing the spool.
+func (c *Client) claimSpooled() []claim {
+	if c.config.SpoolDir == "" {
+		return nil
+	}
+
+	token := "." + randomHex() + claimExt
+	claims := make([]claim, 0, c.config.MaxFlush)
+
+	for _, path := range c.claimable() {
+		if len(claims) == c.config.MaxFlush {
+			break
+		}
+
+		dir, name := filepath.Split(path)
+		base, _, _ := strings.Cut(name, spoolExt)
+		original := dir + base + spoolExt
+		claimed := original + token
+
+		if os.Rename(path, claimed) != nil {
+			continue
+		}
+
+		now := time.Now()
+
+		os.Chtimes(claimed, now, now) //nolint:errcheck
+
+		data, err := os.ReadFile(claimed)
+		if err != nil {
+			os.Rename(claimed, original) //nolint:errcheck
+
+			continue
+		}
+
+		claims = append(claims, claim{path: claimed, original: original, record: string(data)})
+	}
+
+	return claims
+}
+
+// claimable returns the paths of the spooled events that can be claimed, being
+// those not claimed and those with a stale claim, oldest first.
+func (c *Client) claimable() []string {
+	paths, _ := filepath.Glob(filepath.Join(c.config.SpoolDir, "*"+spoolExt))                 //nolint:errcheck
+	claimed, _ := filepath.Glob(filepath.Join(c.config.SpoolDir, "*"+spoolExt+".*"+claimExt)) //nolint:errcheck
+
+	for _, path := range claimed {
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleClaimAge {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+// spool writes the record to a new file in the spool directory.
+func (c *Client) spool(record string) error {
+	name := fmt.Sprintf("%019d-%s%s", time.Now().UnixNano(), randomHex(), spoolExt)
+
+	if err := os.MkdirAll(c.config.SpoolDir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(c.config.SpoolDir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.WriteString(record); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.config.SpoolDir, name))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+func randomHex() string {
+	var b [4]byte
+
+	rand.Read(b[:]) //nolint:errcheck
+
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,254 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+var ErrBadParameter = errors.New("bad parameter")
+
+type apiFunc func(db *DB, params url.Values, q QueryOptions) (any, error)
+
+// newAPIHandler returns a handler for the read-only JSON query API.
+func newAPIHandler(db *DB) http.Handler {
+	mux := http.NewServeMux()
+
+	for path, fn := range map[string]apiFunc{
+		"/api/categories":   apiCategories,
+		"/api/modules":      apiTopModules,
+		"/api/module/users": apiModuleUsers,
+		"/api/user/modules": apiUserModules,
+		"/api/events/count": apiEventCounts,
+	} {
+		mux.Handle(path, apiHandler(db, fn))
+	}
+
+	return mux
+}
+
+func apiHandler(db *DB, fn apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		var result any
+
+		params := r.URL.Query()
+
+		q, err := parseQueryOptions(params)
+		if err == nil {
+			result, err = fn(db, params, q)
+		}
+
+		switch {
+		case errors.Is(err, ErrBadParameter):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrUnknownCategory):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			slog.Error("error running API query", "path", r.URL.Path, "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result) //nolint:errcheck
+		}
+	}
+}
+
+func parseQueryOptions(params url.Values) (QueryOptions, error) {
+	var (
+		q   QueryOptions
+		err error
+	)
+
+	if q.From, err = parseTimeParam(params, "from"); err != nil {
+		return q, err
+	}
+
+	if q.To, err = parseTimeParam(params, "to"); err != nil {
+		return q, err
+	}
+
+	if q.Limit, err = parseIntParam(params, "limit", defaultLimit); err != nil {
+		return q, err
+	} else if q.Limit < 1 || q.Limit > maxLimit {
+		return q, fmt.Errorf("%w: limit must be between 1 and %d", ErrBadParameter, maxLimit)
+	}
+
+	if q.Offset, err = parseIntParam(params, "offset", 0); err != nil {
+		return q, err
+	} else if q.Offset < 0 {
+		return q, fmt.Errorf("%w: offset must not be negative", ErrBadParameter)
+	}
+
+	switch params.Get("time") {
+	case "", "event":
+	case "received":
+		q.Received = true
+	default:
+		return q, fmt.Errorf("%w: time must be event or received", ErrBadParameter)
+	}
+
+	return q, nil
+}
+
+// parseTimeParam accepts either a Unix timestamp or a date, or date and time,
+// in the format accepted by parseTimeFlag.
+func parseTimeParam(params url.Values, name string) (int64, error) {
+	value := params.Get(name)
+
+	if t, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return t, nil
+	}
+
+	t, err := parseTimeFlag(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s time %q", ErrBadParameter, name, value)
+	}
+
+	return t, nil
+}
+
+func parseIntParam(params url.Values, name string, def int) (int, error) {
+	value := params.Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s %q", ErrBadParameter, name, value)
+	}
+
+	return n, nil
+}
+
+func requiredParam(params url.Values, name string) (string, error) {
+	value := params.Get(name)
+	if value == "" {
+		return "", fmt.Errorf("%w: missing %s", ErrBadParameter, name)
+	}
+
+	return value, nil
+}
+
+func apiCategories(db *DB, _ url.Values, _ QueryOptions) (any, error) {
+	return db.Categories(), nil
+}
+
+func apiTopModules(db *DB, params url.Values, q QueryOptions) (any, error) {
+	category, err := requiredParam(params, "category")
+	if err != nil {
+		return nil, err
+	}
+
+	return db.TopModules(category, q)
+}
+
+func apiModuleUsers(db *DB, params url.Values, q QueryOptions) (any, error) {
+	category, err := requiredParam(params, "category")
+	if err != nil {
+		return nil, err
+	}
+
+	module, err := requiredParam(params, "module")
+	if err != nil {
+		return nil, err
+	}
+
+	return db.ModuleUsers(category, module, q)
+}
+
+func apiUserModules(db *DB, params url.Values, q QueryOptions) (any, error) {
+	username, err := requiredParam(params, "username")
+	if err != nil {
+		return nil, err
+	}
+
+	return db.UserModules(username, params.Get("category"), q)
+}
+
+func apiEventCounts(db *DB, params url.Values, q QueryOptions) (any, error) {
+	interval, err := parseIntParam(params, "interval", 0)
+	if err != nil {
+		return nil, err
+	} else if interval < 0 {
+		return nil, fmt.Errorf("%w: interval must not be negative", ErrBadParameter)
+	}
+
+	return db.EventCounts(EventFilter{
+		Username: params.Get("username"),
+		Category: params.Get("category"),
+		Module:   params.Get("module"),
+	}, int64(interval), q)
+}
+
+// serveHTTP starts serving the given handler on the given listener in the
+// background.
+func serveHTTP(l net.Listener, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving HTTP", "err", err)
+		}
+	}()
+
+	return srv
+}
+
+// stopHTTPServer stops the server, waiting a short time for any active requests
+// to complete.
+func stopHTTPServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+	}
+}
@@ -0,0 +1,203 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"), "other", "softpack")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	defer db.Close()
+
+	for n, event := range [...]struct {
+		Username, Category, Module string
+		Time, Received             int64
+	}{
+		{"userA", "other", "moduleA", 100, 0},
+		{"userA", "other", "moduleA", 200, 0},
+		{"userB", "other", "moduleA", 300, 0},
+		{"userB", "other", "moduleB", 400, 0},
+		{"userB", "softpack", "envA", 500, 600},
+		{"userC", "ignore", "", 3700, 7300},
+	} {
+		if err := db.AddEvents([]Event{{
+			Username: event.Username,
+			Command:  "cmd",
+			IP:       "127.0.0.1",
+			Time:     event.Time,
+			Category: event.Category,
+			Module:   event.Module,
+			Received: event.Received,
+		}}); err != nil {
+			t.Fatalf("test %d: unexpected error adding event: %s", n+1, err)
+		}
+	}
+
+	server := httptest.NewServer(newAPIHandler(db))
+	defer server.Close()
+
+	for n, test := range [...]struct {
+		Path           string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{
+			"/api/categories",
+			http.StatusOK,
+			`["other","softpack"]`,
+		},
+		{
+			"/api/modules?category=other",
+			http.StatusOK,
+			`[{"module":"moduleA","users":2,"count":3,"firstuse":100,"lastuse":300},` +
+				`{"module":"moduleB","users":1,"count":1,"firstuse":400,"lastuse":400}]`,
+		},
+		{
+			"/api/modules?category=other&limit=1&offset=1",
+			http.StatusOK,
+			`[{"module":"moduleB","users":1,"count":1,"firstuse":400,"lastuse":400}]`,
+		},
+		{
+			"/api/modules?category=other&from=150&to=350",
+			http.StatusOK,
+			`[{"module":"moduleA","users":2,"count":2,"firstuse":200,"lastuse":300}]`,
+		},
+		{
+			"/api/modules?category=unknown",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"/api/modules",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"/api/modules?category=other&limit=0",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"/api/module/users?category=other&module=moduleA",
+			http.StatusOK,
+			`[{"username":"userA","count":2,"firstuse":100,"lastuse":200},` +
+				`{"username":"userB","count":1,"firstuse":300,"lastuse":300}]`,
+		},
+		{
+			"/api/module/users?category=other&module=moduleA&from=150",
+			http.StatusOK,
+			`[{"username":"userA","count":1,"firstuse":200,"lastuse":200},` +
+				`{"username":"userB","count":1,"firstuse":300,"lastuse":300}]`,
+		},
+		{
+			"/api/user/modules?username=userB",
+			http.StatusOK,
+			`[{"category":"other","module":"moduleA","count":1,"firstuse":300,"lastuse":300},` +
+				`{"category":"other","module":"moduleB","count":1,"firstuse":400,"lastuse":400},` +
+				`{"category":"softpack","module":"envA","count":1,"firstuse":500,"lastuse":500}]`,
+		},
+		{
+			"/api/user/modules?username=userB&category=softpack",
+			http.StatusOK,
+			`[{"category":"softpack","module":"envA","count":1,"firstuse":500,"lastuse":500}]`,
+		},
+		{
+			"/api/user/modules?username=userB&to=350",
+			http.StatusOK,
+			`[{"category":"other","module":"moduleA","count":1,"firstuse":300,"lastuse":300}]`,
+		},
+		{
+			"/api/events/count",
+			http.StatusOK,
+			`[{"time":0,"count":6}]`,
+		},
+		{
+			"/api/events/count?username=userB&from=350",
+			http.StatusOK,
+			`[{"time":350,"count":2}]`,
+		},
+		{
+			"/api/events/count?interval=3600",
+			http.StatusOK,
+			`[{"time":0,"count":5},{"time":3600,"count":1}]`,
+		},
+		{
+			"/api/events/count?interval=3600&time=received",
+			http.StatusOK,
+			`[{"time":0,"count":5},{"time":7200,"count":1}]`,
+		},
+		{
+			"/api/user/modules?username=userB&category=softpack&time=received",
+			http.StatusOK,
+			`[{"category":"softpack","module":"envA","count":1,"firstuse":600,"lastuse":600}]`,
+		},
+		{
+			"/api/modules?category=other&time=received",
+			http.StatusOK,
+			`[{"module":"moduleA","users":2,"count":3,"firstuse":100,"lastuse":300},` +
+				`{"module":"moduleB","users":1,"count":1,"firstuse":400,"lastuse":400}]`,
+		},
+		{
+			"/api/modules?category=other&time=client",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"/api/events/count?from=yesterday",
+			http.StatusBadRequest,
+			"",
+		},
+	} {
+		resp, err := http.Get(server.URL + test.Path)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error making request: %s", n+1, err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatalf("test %d: unexpected error reading response: %s", n+1, err)
+		}
+
+		if resp.StatusCode != test.ExpectedStatus {
+			t.Errorf("test %d: expecting status %d, got %d", n+1, test.ExpectedStatus, resp.StatusCode)
+		} else if test.ExpectedStatus == http.StatusOK && strings.TrimSpace(string(body)) != test.ExpectedBody {
+			t.Errorf("test %d: expecting body:\n%s\ngot:\n%s", n+1, test.ExpectedBody, body)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
+)
+
+// flagUnsigned marks events accepted without a signature in grace mode.
+const flagUnsigned = "unsigned"
+
+const (
+	authOff     = "off"
+	authGrace   = "grace"
+	authRequire = "require"
+)
+
+var (
+	ErrBadSignature = errors.New("bad signature")
+	ErrUnsigned     = errors.New("payload not signed")
+	ErrInvalidKeys  = errors.New("invalid keys file")
+)
+
+// authenticator checks the HMAC signatures of payloads. In grace mode, unsigned
+// payloads are accepted but flagged, and in require mode they are rejected; a
+// bad signature is always rejected, unless authentication is off. The zero
+// value has authentication off.
+type authenticator struct {
+	mode string
+	keys map[string][]byte
+}
+
+// newAuthenticator creates an authenticator with the given mode, loading the
+// accepted keys from the given file, which must be given unless the mode is
+// off.
+//
+// The keys file contains one key per line, as a key ID followed by whitespace
+// and the secret, neither of which may contain whitespace, and the ID may not
+// contain a colon. Blank lines and lines beginning with # are ignored. Multiple
+// keys can be listed to allow them to be rotated.
+func newAuthenticator(mode, keysFile string) (authenticator, error) {
+	switch mode {
+	case authOff:
+		return authenticator{mode: authOff}, nil
+	case authGrace, authRequire:
+	default:
+		return authenticator{}, fmt.Errorf("unknown auth mode %q", mode)
+	}
+
+	if keysFile == "" {
+		return authenticator{}, fmt.Errorf("%w: a keys file is required with auth mode %q", ErrInvalidKeys, mode)
+	}
+
+	f, err := os.Open(keysFile)
+	if err != nil {
+		return authenticator{}, err
+	}
+
+	defer f.Close()
+
+	keys, err := parseKeys(f)
+	if err != nil {
+		return authenticator{}, err
+	}
+
+	return authenticator{mode: mode, keys: keys}, nil
+}
+
+func parseKeys(r io.Reader) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	sc := bufio.NewScanner(r)
+
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, fmt.Errorf("%w: line %d: expecting key ID and secret", ErrInvalidKeys, line)
+		}
+
+		id, secret := fields[0], fields[1]
+
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("%w: line %d: duplicate key ID %q", ErrInvalidKeys, line, id)
+		}
+
+		keys[id] = []byte(secret)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidKeys)
+	}
+
+	return keys, nil
+}
+
+func (a authenticator) enabled() bool {
+	return a.mode == authGrace || a.mode == authRequire
+}
+
+// verifyPayload checks the signature field of the given payload, if any,
+// returning the payload without it and the flags to record on the event.
+func (a authenticator) verifyPayload(data string) (string, []string, error) {
+	if !a.enabled() {
+		return data, nil, nil
+	}
+
+	pos := strings.LastIndex(data, "\x00"+analytics.FieldSignature+"=")
+	if pos == -1 || !strings.HasPrefix(data, analytics.ProtocolMagic+"\x00") {
+		flags, err := a.verifySignature([]byte(data), "")
+
+		return data, flags, err
+	}
+
+	body := data[:pos]
+	flags, err := a.verifySignature([]byte(body), data[pos+len(analytics.FieldSignature)+2:])
+
+	return body, flags, err
+}
+
+// verifySignature checks the given signature, in the same <keyid>:<hex> form as the
+// signature field, over the given body. An empty signature is treated as
+// unsigned.
+func (a authenticator) verifySignature(body []byte, signature string) ([]string, error) {
+	if !a.enabled() {
+		return nil, nil
+	}
+
+	if signature == "" {
+		if err := a.unsigned(); err != nil {
+			return nil, err
+		}
+
+		return []string{flagUnsigned}, nil
+	}
+
+	return nil, a.verify(body, signature)
+}
+
+func (a authenticator) unsigned() error {
+	if a.mode == authRequire {
+		return ErrUnsigned
+	}
+
+	return nil
+}
+
+func (a authenticator) verify(body []byte, signature string) error {
+	id, sig, _ := strings.Cut(strings.TrimSpace(signature), ":")
+
+	key, ok := a.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: unknown key %q", ErrBadSignature, id)
+	}
+
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("%w: invalid hex", ErrBadSignature)
+	}
+
+	if !hmac.Equal(expected, analytics.Sign(key, body)) {
+		return fmt.Errorf("%w: signature does not match", ErrBadSignature)
+	}
+
+	return nil
+}
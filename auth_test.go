@@ -0,0 +1,136 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
+)
+
+func TestParseKeys(t *testing.T) {
+	for n, test := range [...]struct {
+		Input    string
+		Expected map[string]string
+		Error    bool
+	}{
+		{
+			Input:    "# comment\nkey1 secret1\n\n  key2\tsecret2  \n",
+			Expected: map[string]string{"key1": "secret1", "key2": "secret2"},
+		},
+		{
+			Input: "",
+			Error: true,
+		},
+		{
+			Input: "key1\n",
+			Error: true,
+		},
+		{
+			Input: "key:1 secret\n",
+			Error: true,
+		},
+		{
+			Input: "key1 secret1\nkey1 secret2\n",
+			Error: true,
+		},
+	} {
+		keys, err := parseKeys(strings.NewReader(test.Input))
+		if test.Error {
+			if !errors.Is(err, ErrInvalidKeys) {
+				t.Errorf("test %d: expecting invalid keys error, got %v", n+1, err)
+			}
+
+			continue
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if len(keys) != len(test.Expected) {
+			t.Errorf("test %d: expecting %d keys, got %d", n+1, len(test.Expected), len(keys))
+		}
+
+		for id, secret := range test.Expected {
+			if string(keys[id]) != secret {
+				t.Errorf("test %d: expecting key %q to be %q, got %q", n+1, id, secret, keys[id])
+			}
+		}
+	}
+}
+
+func TestVerifyPayload(t *testing.T) {
+	keys := map[string][]byte{"old": []byte("secret1"), "new": []byte("secret2")}
+	body := "SPA1\x00user=USER\x00command=/path/to/command"
+
+	sign := func(id, secret, body string) string {
+		return body + "\x00sig=" + id + ":" + hex.EncodeToString(analytics.Sign([]byte(secret), []byte(body)))
+	}
+
+	for n, test := range [...]struct {
+		Mode          string
+		Input         string
+		ExpectedFlags []string
+		Error         error
+	}{
+		{Mode: authOff, Input: body},
+		{Mode: authOff, Input: body + "\x00sig=bad:00"},
+		{Mode: authGrace, Input: body, ExpectedFlags: []string{flagUnsigned}},
+		{Mode: authGrace, Input: "USER\x00/path/to/command", ExpectedFlags: []string{flagUnsigned}},
+		{Mode: authGrace, Input: sign("old", "secret1", body)},
+		{Mode: authGrace, Input: sign("new", "secret2", body)},
+		{Mode: authGrace, Input: sign("new", "secret1", body), Error: ErrBadSignature},
+		{Mode: authGrace, Input: sign("other", "secret1", body), Error: ErrBadSignature},
+		{Mode: authGrace, Input: body + "\x00sig=new:zz", Error: ErrBadSignature},
+		{Mode: authRequire, Input: sign("new", "secret2", body)},
+		{Mode: authRequire, Input: body, Error: ErrUnsigned},
+		{Mode: authRequire, Input: sign("new", "secret2", body)[1:], Error: ErrUnsigned},
+		{Mode: authRequire, Input: sign("new", "secret2", body) + "\x00host=node1", Error: ErrBadSignature},
+	} {
+		a := authenticator{mode: test.Mode, keys: keys}
+
+		data, flags, err := a.verifyPayload(test.Input)
+		if !errors.Is(err, test.Error) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Error, err)
+		} else if err != nil {
+			continue
+		}
+
+		if !slices.Equal(flags, test.ExpectedFlags) {
+			t.Errorf("test %d: expecting flags %v, got %v", n+1, test.ExpectedFlags, flags)
+		}
+
+		if a.enabled() && strings.Contains(data, "sig=") {
+			t.Errorf("test %d: expecting signature to be removed from payload, got %q", n+1, data)
+		}
+	}
+}
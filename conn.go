@@ -0,0 +1,207 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadTimeout  = 30 * time.Second
+	defaultDrainTimeout = 10 * time.Second
+
+	connPolicyBlock  = "block"
+	connPolicyReject = "reject"
+
+	dropMaxConns = "max_connections"
+)
+
+// connConfig configures the handling of TCP connections. A zero ReadTimeout,
+// MaxConns or DrainTimeout disables that limit.
+type connConfig struct {
+	// ReadTimeout is how long a connection may wait for more data before it
+	// is closed.
+	ReadTimeout time.Duration
+
+	// MaxConns is the maximum number of connections handled at once. When
+	// reached, new connections wait to be accepted, or are closed straight
+	// away if RejectWhenFull is set.
+	MaxConns       int
+	RejectWhenFull bool
+
+	// DrainTimeout is how long to wait for connections to finish once the
+	// listener is closed, before they are forced closed.
+	DrainTimeout time.Duration
+}
+
+// connTracker limits and keeps track of the connections being handled, so that
+// they can be forced closed.
+type connTracker struct {
+	config  connConfig
+	metrics *metrics
+	slots   chan struct{}
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConnTracker(config connConfig, m *metrics) *connTracker {
+	t := &connTracker{
+		config:  config,
+		metrics: m,
+		conns:   make(map[net.Conn]struct{}),
+	}
+
+	if config.MaxConns > 0 {
+		t.slots = make(chan struct{}, config.MaxConns)
+	}
+
+	return t
+}
+
+// reserve blocks until a connection can be handled, when using the block
+// policy.
+func (t *connTracker) reserve() {
+	if t.slots != nil && !t.config.RejectWhenFull {
+		t.slots <- struct{}{}
+	}
+}
+
+// unreserve gives back a reservation that was not used by a connection.
+func (t *connTracker) unreserve() {
+	if t.slots != nil && !t.config.RejectWhenFull {
+		<-t.slots
+	}
+}
+
+// add starts tracking the given connection, returning false if it should be
+// rejected because too many are being handled, when using the reject policy.
+func (t *connTracker) add(c net.Conn) bool {
+	if t.slots != nil && t.config.RejectWhenFull {
+		select {
+		case t.slots <- struct{}{}:
+		default:
+			t.metrics.dropped.WithLabelValues(dropMaxConns).Inc()
+
+			return false
+		}
+	}
+
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	t.metrics.activeConns.Inc()
+
+	return true
+}
+
+func (t *connTracker) done(c net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+
+	if t.slots != nil {
+		<-t.slots
+	}
+
+	t.metrics.activeConns.Dec()
+	t.wg.Done()
+}
+
+// drain waits for the connections being handled to finish, closing any that
+// are still open after the drain timeout.
+func (t *connTracker) drain() {
+	finished := make(chan struct{})
+
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	if t.config.DrainTimeout <= 0 {
+		<-finished
+
+		return
+	}
+
+	select {
+	case <-finished:
+		return
+	case <-time.After(t.config.DrainTimeout):
+	}
+
+	t.mu.Lock()
+
+	slog.Warn("closing connections that did not finish before the drain timeout", "count", len(t.conns))
+
+	for c := range t.conns {
+		c.Close()
+	}
+
+	t.mu.Unlock()
+
+	<-finished
+}
+
+// deadlineReader sets a read deadline on the connection before each read, so
+// that a connection is closed only once it has been idle for the timeout.
+type deadlineReader struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func withReadTimeout(c net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return c
+	}
+
+	return &deadlineReader{Conn: c, timeout: timeout}
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if err := d.Conn.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+
+	return d.Conn.Read(p)
+}
+
+func readErrorReason(err error) string {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "timeout"
+	}
+
+	return "read_error"
+}
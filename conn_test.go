@@ -0,0 +1,182 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimits(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{Conns: connConfig{
+		ReadTimeout:    200 * time.Millisecond,
+		MaxConns:       1,
+		RejectWhenFull: true,
+		DrainTimeout:   100 * time.Millisecond,
+	}})
+
+	stopped := make(chan error)
+
+	go func() { stopped <- newAnalyticsServer(l, in) }()
+
+	idle := dialTest(t, l)
+
+	io.WriteString(idle, "USER\x00") //nolint:errcheck
+
+	time.Sleep(50 * time.Millisecond)
+
+	if !isClosedWithin(dialTest(t, l), 50*time.Millisecond) {
+		t.Errorf("expecting connection over the maximum to be closed")
+	}
+
+	if !isClosedWithin(idle, time.Second) {
+		t.Errorf("expecting idle connection to be closed after the read timeout")
+	}
+
+	next := dialTest(t, l)
+
+	if isClosedWithin(next, 50*time.Millisecond) {
+		t.Errorf("expecting new connection to be accepted once another has closed")
+	}
+
+	if !isClosedWithin(next, 300*time.Millisecond) {
+		t.Errorf("expecting idle connection to be closed after the read timeout")
+	}
+
+	slow := dialTest(t, l)
+
+	for n := 0; n < 3; n++ {
+		time.Sleep(100 * time.Millisecond)
+
+		io.WriteString(slow, "x") //nolint:errcheck
+	}
+
+	l.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("expecting server to stop after the drain timeout")
+	}
+
+	if !isClosedWithin(slow, 50*time.Millisecond) {
+		t.Errorf("expecting connection to be closed after the drain timeout")
+	}
+}
+
+func TestConnLimitsShared(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	var listeners [2]net.Listener
+
+	for n := range listeners {
+		if listeners[n], err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			t.Fatalf("unexpected error creating listener: %s", err)
+		}
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{Conns: connConfig{
+		MaxConns:       1,
+		RejectWhenFull: true,
+		DrainTimeout:   100 * time.Millisecond,
+	}})
+
+	stopped := make(chan error)
+
+	go func() { stopped <- serveListeners(in, listeners[:]...) }()
+
+	idle := dialTest(t, listeners[0])
+
+	io.WriteString(idle, "USER\x00") //nolint:errcheck
+
+	time.Sleep(50 * time.Millisecond)
+
+	if !isClosedWithin(dialTest(t, listeners[1]), 50*time.Millisecond) {
+		t.Errorf("expecting connection over the maximum of all listeners to be closed")
+	}
+
+	listeners[0].Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("expecting server to stop after the drain timeout")
+	}
+
+	if !isClosedWithin(idle, 50*time.Millisecond) {
+		t.Errorf("expecting connection to be closed after the drain timeout")
+	}
+}
+
+func dialTest(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error opening connection: %s", err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// isClosedWithin returns true if the server closes the connection before the
+// timeout.
+func isClosedWithin(c net.Conn, timeout time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(timeout)) //nolint:errcheck
+
+	_, err := c.Read(make([]byte, 1))
+
+	return errors.Is(err, io.EOF)
+}
@@ -28,27 +28,51 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
 	addEvent = iota
-	addSoftpackEvent
-	addCondaEvent
-	addOtherEvent
-
 	readEvents
+	importEvent
+	relayedEvent
+)
+
+const readEventsSQL = "SELECT username, command, ip, time FROM [events];"
+
+// eventColumns are the columns of the events table written by the insert
+// statements, in the order of their parameters.
+const eventColumns = "username, command, ip, time, category, module, hostname, cwd, jobid, version, received, " +
+	"flags, verified_username, relay_id"
+
+var (
+	ErrUnknownCategory = errors.New("unknown category")
+
+	categoryName = regexp.MustCompile("^[a-z][a-z0-9_]*$")
 )
 
 type DB struct {
-	db *sql.DB
+	db     *sql.DB
+	reader *sql.DB
 
-	statements [5]*sql.Stmt
+	statements [4]*sql.Stmt
+	categories map[string]*sql.Stmt
 }
 
-func NewDB(path string) (*DB, error) {
+// NewDB opens the database at the given path, creating the events table and a
+// module table for each of the given categories.
+func NewDB(path string, categories ...string) (*DB, error) {
 	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, fmt.Errorf("error opening database: %w", err)
@@ -58,77 +82,637 @@ func NewDB(path string) (*DB, error) {
 
 	for _, table := range [...]string{
 		`CREATE TABLE IF NOT EXISTS [events] (username TEXT, command string, ip string, time INTEGER)`,
-		`CREATE TABLE IF NOT EXISTS [softpackmodules] (module TEXT CHECK (module NOT LIKE ""), username TEXT, count INTEGER DEFAULT 1, firstuse INTEGER, lastuse INTEGER, CONSTRAINT usermodule UNIQUE(module, username))`,
-		`CREATE INDEX IF NOT EXISTS modulename ON [softpackmodules] (module)`,
-		`CREATE TABLE IF NOT EXISTS [condamodules] (module TEXT CHECK (module NOT LIKE ""), username TEXT, count INTEGER DEFAULT 1, firstuse INTEGER, lastuse INTEGER, CONSTRAINT usermodule UNIQUE(module, username))`,
-		`CREATE INDEX IF NOT EXISTS modulename ON [condamodules] (module)`,
-		`CREATE TABLE IF NOT EXISTS [othermodules] (module TEXT CHECK (module NOT LIKE ""), username TEXT, count INTEGER DEFAULT 1, firstuse INTEGER, lastuse INTEGER, CONSTRAINT usermodule UNIQUE(module, username))`,
-		`CREATE INDEX IF NOT EXISTS modulename ON [othermodules] (module)`,
+		`CREATE INDEX IF NOT EXISTS eventtime ON [events] (time)`,
+		`CREATE INDEX IF NOT EXISTS eventuser ON [events] (username)`,
+		// earlier versions created an index with this name on only the first module table.
+		`DROP INDEX IF EXISTS modulename`,
 	} {
 		if _, err := db.Exec(table); err != nil {
 			return nil, fmt.Errorf("error creating initial table with sql %q: %w", table, err)
 		}
 	}
 
-	d := &DB{db: db}
+	if err := addMissingColumns(db, "events", [][2]string{
+		{"category", "TEXT"},
+		{"module", "TEXT"},
+		{"hostname", "TEXT"},
+		{"cwd", "TEXT"},
+		{"jobid", "TEXT"},
+		{"version", "TEXT"},
+		{"received", "INTEGER"},
+		{"flags", "TEXT"},
+		{"verified_username", "TEXT"},
+		{"relay_id", "TEXT"},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS eventrelayid ON [events] (relay_id)`); err != nil {
+		return nil, fmt.Errorf("error creating relay ID index: %w", err)
+	}
+
+	d := &DB{db: db, reader: db, categories: make(map[string]*sql.Stmt)}
+
+	if err := d.openReader(path); err != nil {
+		return nil, err
+	}
 
 	for n, sql := range [...]string{
-		"INSERT INTO [events] (username, command, ip, time) VALUES (?, ?, ?, ?);",
-		"INSERT OR IGNORE INTO [softpackmodules] (module, username, firstuse, lastuse) VALUES (?, ?, ?, ?) ON CONFLICT DO UPDATE SET count = count + 1, firstuse = MIN(firstuse, excluded.firstuse), lastuse = MAX(lastuse, excluded.lastuse);",
-		"INSERT OR IGNORE INTO [condamodules] (module, username, firstuse, lastuse) VALUES (?, ?, ?, ?) ON CONFLICT DO UPDATE SET count = count + 1, firstuse = MIN(firstuse, excluded.firstuse), lastuse = MAX(lastuse, excluded.lastuse);",
-		"INSERT OR IGNORE INTO [othermodules] (module, username, firstuse, lastuse) VALUES (?, ?, ?, ?) ON CONFLICT DO UPDATE SET count = count + 1, firstuse = MIN(firstuse, excluded.firstuse), lastuse = MAX(lastuse, excluded.lastuse);",
-		"SELECT username, command, ip, time FROM [events];",
+		"INSERT INTO [events] (" + eventColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), ?, " +
+			"NULLIF(?, ''), NULLIF(?, ''));",
+		readEventsSQL,
+		"INSERT INTO [events] (" + eventColumns + ") SELECT ?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, " +
+			"NULLIF(?11, 0), ?12, NULLIF(?13, ''), NULLIF(?14, '') WHERE NOT EXISTS (SELECT 1 FROM [events] " +
+			"WHERE time IS ?4 AND username IS ?1 AND command IS ?2 AND ip IS ?3);",
+		"INSERT OR IGNORE INTO [events] (" + eventColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, " +
+			"NULLIF(?, 0), ?, NULLIF(?, ''), NULLIF(?, ''));",
 	} {
 		if d.statements[n], err = db.Prepare(sql); err != nil {
 			return nil, fmt.Errorf("error creating prepared statement with sql %q: %w", sql, err)
 		}
 	}
 
+	for _, category := range categories {
+		if err := d.addCategory(category); err != nil {
+			return nil, err
+		}
+	}
+
 	return d, nil
 }
 
-func (d *DB) AddSoftpack(username, command, module, ip string, now int64) error {
-	return d.add(username, command, module, ip, addSoftpackEvent, now)
+// OpenDBReadOnly opens the existing database at the given path read-only,
+// without creating or upgrading any tables, for use by the query methods. Every
+// module table in the database can be queried.
+func OpenDBReadOnly(path string) (*DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	uri, err := readOnlyURI(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	d := &DB{db: db, reader: db, categories: make(map[string]*sql.Stmt)}
+
+	categories, err := d.moduleCategories(db)
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	for _, category := range categories {
+		d.categories[category] = nil
+	}
+
+	if d.statements[readEvents], err = db.Prepare(readEventsSQL); err != nil {
+		db.Close()
+
+		return nil, fmt.Errorf("error creating prepared statement with sql %q: %w", readEventsSQL, err)
+	}
+
+	return d, nil
 }
 
-func (d *DB) AddConda(username, command, module, ip string, now int64) error {
-	return d.add(username, command, module, ip, addCondaEvent, now)
+// openReader opens a separate, read-only, connection pool for file databases,
+// switching them to WAL mode so that queries do not block writes.
+func (d *DB) openReader(path string) error {
+	if path == "" || path == ":memory:" || strings.HasPrefix(path, "file:") {
+		return nil
+	}
+
+	if _, err := d.db.Exec("PRAGMA journal_mode=WAL;"); err != nil {
+		return fmt.Errorf("error enabling WAL mode: %w", err)
+	}
+
+	uri, err := readOnlyURI(path)
+	if err != nil {
+		return fmt.Errorf("error opening database reader: %w", err)
+	}
+
+	reader, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return fmt.Errorf("error opening database reader: %w", err)
+	}
+
+	d.reader = reader
+
+	return nil
 }
 
-func (d *DB) AddOther(username, command, module, ip string, now int64) error {
-	return d.add(username, command, module, ip, addOtherEvent, now)
+// readOnlyURI returns a URI that opens the database file at the given path
+// read-only.
+func readOnlyURI(path string) (string, error) {
+	// a relative path would be parsed as the authority of the URI.
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	u := url.URL{Scheme: "file", Path: abs, RawQuery: "mode=ro&_busy_timeout=5000"}
+
+	return u.String(), nil
 }
 
-func (d *DB) AddEvent(username, command, _, ip string, now int64) error {
-	if _, err := d.statements[addEvent].Exec(username, command, ip, now); err != nil {
-		return fmt.Errorf("error adding to database (%s, %s, %d, %s): %w", username, ip, now, command, err)
+// addMissingColumns adds any of the given name/type pairs that do not exist in
+// the given table, so that databases created by earlier versions can be used.
+func addMissingColumns(db *sql.DB, table string, columns [][2]string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?);", table)
+	if err != nil {
+		return fmt.Errorf("error reading columns of table %q: %w", table, err)
+	}
+
+	existing := make(map[string]bool)
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+
+			return fmt.Errorf("error reading columns of table %q: %w", table, err)
+		}
+
+		existing[name] = true
+	}
+
+	rows.Close()
+
+	for _, column := range columns {
+		if existing[column[0]] {
+			continue
+		}
+
+		sql := "ALTER TABLE [" + table + "] ADD COLUMN " + column[0] + " " + column[1] + ";"
+
+		if _, err := db.Exec(sql); err != nil {
+			return fmt.Errorf("error adding column with sql %q: %w", sql, err)
+		}
 	}
 
 	return nil
 }
 
-func (d *DB) add(username, command, module, ip string, sub int, now int64) error {
-	if err := d.AddEvent(username, command, module, ip, now); err != nil {
-		return err
+func validCategory(category string) bool {
+	return categoryName.MatchString(category)
+}
+
+func moduleTable(category string) string {
+	return "[" + category + "modules]"
+}
+
+func createModuleTable(category, table string) [2]string {
+	return [...]string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (module TEXT CHECK (module NOT LIKE ""), username TEXT, count INTEGER DEFAULT 1, firstuse INTEGER, lastuse INTEGER, CONSTRAINT usermodule UNIQUE(module, username))`,
+		`CREATE INDEX IF NOT EXISTS [` + category + `modulename] ON ` + table + ` (module)`,
+	}
+}
+
+func (d *DB) addCategory(category string) error {
+	if !validCategory(category) {
+		return fmt.Errorf("%w: invalid category name %q", ErrUnknownCategory, category)
+	} else if _, ok := d.categories[category]; ok {
+		return nil
+	}
+
+	table := moduleTable(category)
+
+	for _, sql := range createModuleTable(category, table) {
+		if _, err := d.db.Exec(sql); err != nil {
+			return fmt.Errorf("error creating table for category %q with sql %q: %w", category, sql, err)
+		}
 	}
 
-	if _, err := d.statements[sub].Exec(module, username, now, now); err != nil {
-		return fmt.Errorf("error adding to database (%s, %s, %s, %d, %s): %w", module, username, ip, now, command, err)
+	sql := "INSERT OR IGNORE INTO " + table + " (module, username, firstuse, lastuse) VALUES (?, ?, ?, ?) ON CONFLICT DO UPDATE SET count = count + 1, firstuse = MIN(firstuse, excluded.firstuse), lastuse = MAX(lastuse, excluded.lastuse);"
+
+	stmt, err := d.db.Prepare(sql)
+	if err != nil {
+		return fmt.Errorf("error creating prepared statement with sql %q: %w", sql, err)
 	}
 
+	d.categories[category] = stmt
+
 	return nil
 }
 
+// Categories returns the names of the module categories known to the database.
+func (d *DB) Categories() []string {
+	categories := make([]string, 0, len(d.categories))
+
+	for category := range d.categories {
+		categories = append(categories, category)
+	}
+
+	sort.Strings(categories)
+
+	return categories
+}
+
+// Event is a single use of a command, along with its classification. Time is
+// when the command was run, according to the client if it said, and Received is
+// when the server received the event, or zero if not known. VerifiedUsername is
+// the username of the sender as verified by the server, or empty if it could not
+// be. RelayID identifies an event forwarded by a relay, so that it is recorded
+// only once however many times it is forwarded.
+type Event struct {
+	Username string
+	Command  string
+	IP       string
+	Time     int64
+	Category string
+	Module   string
+	Hostname string
+	Cwd      string
+	JobID    string
+	Version  string
+	Received int64
+	Flags    string
+
+	VerifiedUsername string
+	RelayID          string
+}
+
+// Add records an event and, when a module is given, updates the usage of that
+// module in the table for the given category.
+func (d *DB) Add(username, command, category, module, ip string, now int64) error {
+	return d.AddEvents([]Event{{
+		Username: username,
+		Command:  command,
+		IP:       ip,
+		Time:     now,
+		Category: category,
+		Module:   module,
+	}})
+}
+
+// AddEvents records the given events within a single transaction; if any event
+// cannot be added, none are.
+func (d *DB) AddEvents(events []Event) error {
+	_, err := d.addEvents(addEvent, events)
+
+	return err
+}
+
+// ImportEvents records, within a single transaction, those of the given events
+// that are not already in the database, returning the number recorded. An event
+// is already in the database if one exists with the same username, command, IP
+// and time.
+func (d *DB) ImportEvents(events []Event) (int, error) {
+	return d.addEvents(importEvent, events)
+}
+
+// RelayEvents records, within a single transaction, those of the given events
+// forwarded by a relay whose relay IDs are not already in the database,
+// returning the number recorded. Events without a relay ID are always recorded.
+func (d *DB) RelayEvents(events []Event) (int, error) {
+	return d.addEvents(relayedEvent, events)
+}
+
+// addEvents adds the events with the given insert statement within a single
+// transaction, returning the number inserted.
+func (d *DB) addEvents(insert int, events []Event) (int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck
+
+	count := 0
+
+	for _, event := range events {
+		added, err := d.add(tx.Stmt, insert, event)
+		if err != nil {
+			return 0, err
+		} else if added {
+			count++
+		}
+	}
+
+	return count, tx.Commit()
+}
+
+// add inserts the event with the given insert statement and, if it was
+// inserted and has a module, updates the usage of that module.
+func (d *DB) add(stmt func(*sql.Stmt) *sql.Stmt, insert int, e Event) (bool, error) {
+	if e.Module == "" {
+		return d.addEvent(stmt, insert, e)
+	}
+
+	addModule, ok := d.categories[e.Category]
+	if !ok {
+		return false, fmt.Errorf("%w: %q", ErrUnknownCategory, e.Category)
+	}
+
+	if added, err := d.addEvent(stmt, insert, e); err != nil || !added {
+		return false, err
+	}
+
+	if _, err := stmt(addModule).Exec(e.Module, e.Username, e.Time, e.Time); err != nil {
+		return false, fmt.Errorf("error adding to database (%s, %s, %s, %d, %s): %w", e.Module, e.Username, e.IP, e.Time, e.Command, err)
+	}
+
+	return true, nil
+}
+
+func (d *DB) addEvent(stmt func(*sql.Stmt) *sql.Stmt, insert int, e Event) (bool, error) {
+	res, err := stmt(d.statements[insert]).Exec(e.Username, e.Command, e.IP, e.Time, e.Category, e.Module,
+		e.Hostname, e.Cwd, e.JobID, e.Version, e.Received, e.Flags, e.VerifiedUsername, e.RelayID)
+	if err != nil {
+		return false, fmt.Errorf("error adding to database (%s, %s, %d, %s): %w", e.Username, e.IP, e.Time, e.Command, err)
+	}
+
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
 func (d *DB) ReadEvents() (*sql.Rows, error) {
 	return d.statements[readEvents].Query()
 }
 
-func (d *DB) SaveTo(path string) error {
-	_, err := d.db.Exec(fmt.Sprintf("VACUUM INTO %q", path))
+// Reclassify re-runs the given classifier over the events table and then
+// rebuilds the module tables from the updated events, all within a single
+// transaction.
+//
+// When from or to are non-zero, only events with a time in the range [from, to)
+// are reclassified, along with any events that have never been classified;
+// other events keep their existing classification.
+//
+// The progress function, if not nil, is called periodically with the number of
+// events reclassified so far.
+func (d *DB) Reclassify(classify func(string) (string, string), from, to int64, progress func(int)) error {
+	if to == 0 {
+		to = math.MaxInt64
+	}
 
-	return err
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck
+
+	count, err := reclassifyEvents(tx, classify, from, to, progress)
+	if err != nil {
+		return err
+	}
+
+	if progress != nil {
+		progress(count)
+	}
+
+	categories, err := d.moduleCategories(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, category := range categories {
+		if err := rebuildModuleTable(tx, category); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// moduleCategories returns the categories of the rules along with those of any
+// other module tables in the database, such as those of categories that have
+// been removed from the rules.
+func (d *DB) moduleCategories(q querier) ([]string, error) {
+	rows, err := q.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE '%modules';")
+	if err != nil {
+		return nil, fmt.Errorf("error reading module tables: %w", err)
+	}
+
+	defer rows.Close()
+
+	categories := d.Categories()
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("error reading module tables: %w", err)
+		}
+
+		category := strings.TrimSuffix(name, "modules")
+
+		if _, ok := d.categories[category]; !ok && validCategory(category) {
+			categories = append(categories, category)
+		}
+	}
+
+	sort.Strings(categories)
+
+	return categories, rows.Err()
+}
+
+func reclassifyEvents(tx *sql.Tx, classify func(string) (string, string), from, to int64,
+	progress func(int)) (int, error) {
+	update, err := tx.Prepare("UPDATE [events] SET category = ?, module = ? WHERE rowid = ?;")
+	if err != nil {
+		return 0, fmt.Errorf("error preparing update: %w", err)
+	}
+
+	defer update.Close()
+
+	rows, err := tx.Query("SELECT rowid, command FROM [events] WHERE category IS NULL OR (time >= ? AND time < ?);", from, to)
+	if err != nil {
+		return 0, fmt.Errorf("error reading events: %w", err)
+	}
+
+	defer rows.Close()
+
+	count := 0
+
+	for rows.Next() {
+		var (
+			rowid   int64
+			command string
+		)
+
+		if err := rows.Scan(&rowid, &command); err != nil {
+			return 0, fmt.Errorf("error reading row: %w", err)
+		}
+
+		category, module := classify(command)
+
+		if _, err := update.Exec(category, module, rowid); err != nil {
+			return 0, fmt.Errorf("error updating event %d: %w", rowid, err)
+		}
+
+		count++
+
+		if progress != nil && count%1000 == 0 {
+			progress(count)
+		}
+	}
+
+	return count, rows.Err()
+}
+
+// expectedModuleUsage calculates the contents of a module table from the
+// classified events.
+const expectedModuleUsage = "SELECT module, username, COUNT(*) AS count, MIN(time) AS firstuse, MAX(time) AS lastuse " +
+	"FROM [events] WHERE category = ? AND module != '' GROUP BY module, username"
+
+// rebuildModuleTable builds a new module table for the given category from the
+// classified events and then replaces the existing table with it.
+func rebuildModuleTable(tx *sql.Tx, category string) error {
+	table := moduleTable(category)
+	tmp := "[" + category + "modules_new]"
+
+	for _, stmt := range [...]struct {
+		sql  string
+		args []any
+	}{
+		{sql: "DROP TABLE IF EXISTS " + tmp + ";"},
+		{sql: createModuleTable(category, tmp)[0]},
+		{
+			sql:  "INSERT INTO " + tmp + " (module, username, count, firstuse, lastuse) " + expectedModuleUsage + ";",
+			args: []any{category},
+		},
+		{sql: "DROP TABLE " + table + ";"},
+		{sql: "ALTER TABLE " + tmp + " RENAME TO " + table + ";"},
+		{sql: createModuleTable(category, table)[1]},
+	} {
+		if _, err := tx.Exec(stmt.sql, stmt.args...); err != nil {
+			return fmt.Errorf("error rebuilding table for category %q with sql %q: %w", category, stmt.sql, err)
+		}
+	}
+
+	return nil
+}
+
+// Usage is the count, first use and last use of a module by a user.
+type Usage struct {
+	Count    int64
+	FirstUse int64
+	LastUse  int64
+}
+
+// Drift is a difference between a module table and the usage calculated from
+// the events table. A nil Expected or Actual means that the row is missing from
+// the events or the module table, respectively.
+type Drift struct {
+	Category string
+	Module   string
+	Username string
+	Expected *Usage
+	Actual   *Usage
+}
+
+// Verify recalculates the module tables, including those of categories no
+// longer in the rules, from the classified events and returns any differences,
+// along with the number of events that have never been classified, and so
+// cannot be verified.
+func (d *DB) Verify() ([]Drift, int64, error) {
+	var unclassified int64
+
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM [events] WHERE category IS NULL;").Scan(&unclassified); err != nil {
+		return nil, 0, fmt.Errorf("error counting unclassified events: %w", err)
+	}
+
+	categories, err := d.moduleCategories(d.db)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var drifts []Drift
+
+	for _, category := range categories {
+		drift, err := d.verifyCategory(category)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		drifts = append(drifts, drift...)
+	}
+
+	return drifts, unclassified, nil
+}
+
+func (d *DB) verifyCategory(category string) ([]Drift, error) {
+	table := moduleTable(category)
+	query := "WITH expected AS (" + expectedModuleUsage + ") " +
+		"SELECT e.module, e.username, e.count, e.firstuse, e.lastuse, a.count, a.firstuse, a.lastuse " +
+		"FROM expected e LEFT JOIN " + table + " a USING (module, username) " +
+		"WHERE a.count IS NOT e.count OR a.firstuse IS NOT e.firstuse OR a.lastuse IS NOT e.lastuse " +
+		"UNION ALL " +
+		"SELECT a.module, a.username, NULL, NULL, NULL, a.count, a.firstuse, a.lastuse " +
+		"FROM " + table + " a LEFT JOIN expected e USING (module, username) WHERE e.module IS NULL " +
+		"ORDER BY 1, 2;"
+
+	return queryRows(d.db, query, []any{category}, func(rows *sql.Rows) (Drift, error) {
+		var (
+			drift            = Drift{Category: category}
+			expected, actual [3]sql.NullInt64
+		)
+
+		if err := rows.Scan(&drift.Module, &drift.Username, &expected[0], &expected[1], &expected[2],
+			&actual[0], &actual[1], &actual[2]); err != nil {
+			return drift, err
+		}
+
+		drift.Expected = nullUsage(expected)
+		drift.Actual = nullUsage(actual)
+
+		return drift, nil
+	})
+}
+
+func nullUsage(values [3]sql.NullInt64) *Usage {
+	if !values[0].Valid {
+		return nil
+	}
+
+	return &Usage{Count: values[0].Int64, FirstUse: values[1].Int64, LastUse: values[2].Int64}
+}
+
+// Repair rebuilds the module tables of the given categories, which need not be
+// in the rules, from the classified events, in a single transaction.
+func (d *DB) Repair(categories ...string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck
+
+	existing, err := d.moduleCategories(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, category := range categories {
+		if !slices.Contains(existing, category) {
+			return fmt.Errorf("%w: %q", ErrUnknownCategory, category)
+		}
+
+		if err := rebuildModuleTable(tx, category); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 func (d *DB) Close() error {
+	if d.reader != d.db {
+		d.reader.Close()
+	}
+
 	return d.db.Close()
 }
@@ -27,15 +27,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 )
 
 func TestDB(t *testing.T) {
-	db, err := NewDB(":memory:")
+	db, err := NewDB(":memory:", "other")
 	if err != nil {
 		t.Fatalf("unexpected error creating DB: %s", err)
 	}
@@ -56,7 +59,7 @@ func TestDB(t *testing.T) {
 			"",
 			net.IPv4(192, 168, 1, 1),
 			time.Unix(1, 0),
-			"userA,some command 1,192.168.1.1,1\n",
+			"userA,some command 1,192.168.1.1,1,other,,,,,,<nil>,,<nil>,<nil>\n",
 			"",
 			"",
 		},
@@ -66,8 +69,8 @@ func TestDB(t *testing.T) {
 			"moduleA",
 			net.IPv4(192, 168, 1, 1),
 			time.Unix(2, 0),
-			"userA,some command 1,192.168.1.1,1\n" +
-				"userA,some command 2,192.168.1.1,2\n",
+			"userA,some command 1,192.168.1.1,1,other,,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 2,192.168.1.1,2,other,moduleA,,,,,<nil>,,<nil>,<nil>\n",
 			"moduleA,1,2,2\n",
 			"moduleA,userA,1,2,2\n",
 		},
@@ -77,9 +80,9 @@ func TestDB(t *testing.T) {
 			"moduleA",
 			net.IPv4(192, 168, 1, 1),
 			time.Unix(3, 0),
-			"userA,some command 1,192.168.1.1,1\n" +
-				"userA,some command 2,192.168.1.1,2\n" +
-				"userA,some command 3,192.168.1.1,3\n",
+			"userA,some command 1,192.168.1.1,1,other,,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 2,192.168.1.1,2,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 3,192.168.1.1,3,other,moduleA,,,,,<nil>,,<nil>,<nil>\n",
 			"moduleA,2,2,3\n",
 			"moduleA,userA,2,2,3\n",
 		},
@@ -89,10 +92,10 @@ func TestDB(t *testing.T) {
 			"moduleA",
 			net.IPv4(192, 168, 1, 2),
 			time.Unix(4, 0),
-			"userA,some command 1,192.168.1.1,1\n" +
-				"userA,some command 2,192.168.1.1,2\n" +
-				"userA,some command 3,192.168.1.1,3\n" +
-				"userB,some command 2,192.168.1.2,4\n",
+			"userA,some command 1,192.168.1.1,1,other,,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 2,192.168.1.1,2,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 3,192.168.1.1,3,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userB,some command 2,192.168.1.2,4,other,moduleA,,,,,<nil>,,<nil>,<nil>\n",
 			"moduleA,3,2,4\n",
 			"moduleA,userA,2,2,3\n" +
 				"moduleA,userB,1,4,4\n",
@@ -103,11 +106,11 @@ func TestDB(t *testing.T) {
 			"moduleB",
 			net.IPv4(192, 168, 1, 2),
 			time.Unix(5, 0),
-			"userA,some command 1,192.168.1.1,1\n" +
-				"userA,some command 2,192.168.1.1,2\n" +
-				"userA,some command 3,192.168.1.1,3\n" +
-				"userB,some command 2,192.168.1.2,4\n" +
-				"userB,some command 4,192.168.1.2,5\n",
+			"userA,some command 1,192.168.1.1,1,other,,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 2,192.168.1.1,2,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 3,192.168.1.1,3,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userB,some command 2,192.168.1.2,4,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userB,some command 4,192.168.1.2,5,other,moduleB,,,,,<nil>,,<nil>,<nil>\n",
 			"moduleA,3,2,4\n" +
 				"moduleB,1,5,5\n",
 			"moduleA,userA,2,2,3\n" +
@@ -120,12 +123,12 @@ func TestDB(t *testing.T) {
 			"moduleB",
 			net.IPv4(192, 168, 1, 2),
 			time.Unix(1, 0),
-			"userA,some command 1,192.168.1.1,1\n" +
-				"userA,some command 2,192.168.1.1,2\n" +
-				"userA,some command 3,192.168.1.1,3\n" +
-				"userB,some command 2,192.168.1.2,4\n" +
-				"userB,some command 4,192.168.1.2,5\n" +
-				"userB,some command 4,192.168.1.2,1\n",
+			"userA,some command 1,192.168.1.1,1,other,,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 2,192.168.1.1,2,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userA,some command 3,192.168.1.1,3,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userB,some command 2,192.168.1.2,4,other,moduleA,,,,,<nil>,,<nil>,<nil>\n" +
+				"userB,some command 4,192.168.1.2,5,other,moduleB,,,,,<nil>,,<nil>,<nil>\n" +
+				"userB,some command 4,192.168.1.2,1,other,moduleB,,,,,<nil>,,<nil>,<nil>\n",
 			"moduleA,3,2,4\n" +
 				"moduleB,2,1,5\n",
 			"moduleA,userA,2,2,3\n" +
@@ -133,7 +136,7 @@ func TestDB(t *testing.T) {
 				"moduleB,userB,2,1,5\n",
 		},
 	} {
-		if err := db.AddOther(test.Username, test.Command, test.Module, test.IP.String(), test.Time.Unix()); err != nil {
+		if err := db.Add(test.Username, test.Command, "other", test.Module, test.IP.String(), test.Time.Unix()); err != nil {
 			t.Errorf("test %d: unexpected error adding event: %s", n+1, err)
 
 			continue
@@ -147,6 +150,304 @@ func TestDB(t *testing.T) {
 	}
 }
 
+func TestDBCategories(t *testing.T) {
+	db, err := NewDB(":memory:", "apptainer", "rlibs")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	if categories := strings.Join(db.Categories(), ","); categories != "apptainer,rlibs" {
+		t.Errorf("expecting categories %q, got %q", "apptainer,rlibs", categories)
+	}
+
+	if err := db.Add("userA", "some command 1", "apptainer", "imageA", "192.168.1.1", 1); err != nil {
+		t.Fatalf("unexpected error adding event: %s", err)
+	}
+
+	if err := db.Add("userA", "some command 2", "rlibs", "libA", "192.168.1.1", 2); err != nil {
+		t.Fatalf("unexpected error adding event: %s", err)
+	}
+
+	if err := db.Add("userA", "some command 3", "unknown", "modA", "192.168.1.1", 3); !errors.Is(err, ErrUnknownCategory) {
+		t.Errorf("expecting unknown category error, got %v", err)
+	}
+
+	if _, err := NewDB(":memory:", "bad]name"); !errors.Is(err, ErrUnknownCategory) {
+		t.Errorf("expecting invalid category error, got %v", err)
+	}
+
+	if table := dumpTable(t, db, "apptainermodules"); table != "imageA,userA,1,1,1\n" {
+		t.Errorf("expected apptainermodules table to be:\n%s\ngot:\n%s", "imageA,userA,1,1,1\n", table)
+	} else if table = dumpTable(t, db, "rlibsmodules"); table != "libA,userA,1,2,2\n" {
+		t.Errorf("expected rlibsmodules table to be:\n%s\ngot:\n%s", "libA,userA,1,2,2\n", table)
+	} else if table = dumpTable(t, db, "events"); table != "userA,some command 1,192.168.1.1,1,apptainer,imageA,,,,,<nil>,,<nil>,<nil>\nuserA,some command 2,192.168.1.1,2,rlibs,libA,,,,,<nil>,,<nil>,<nil>\n" {
+		t.Errorf("unexpected events table:\n%s", table)
+	}
+}
+
+func TestDBRelativePath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error getting working directory: %s", err)
+	}
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("unexpected error changing directory: %s", err)
+	}
+
+	defer os.Chdir(wd) //nolint:errcheck
+
+	db, err := NewDB("rel.db", "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	defer db.Close()
+
+	if err := db.Add("userA", "/a/x", "other", "x", "127.0.0.1", 1); err != nil {
+		t.Fatalf("unexpected error adding event: %s", err)
+	}
+
+	if users, modules, err := db.CategoryStats("other"); err != nil {
+		t.Errorf("unexpected error querying through reader: %s", err)
+	} else if users != 1 || modules != 1 {
+		t.Errorf("expecting 1 user and 1 module, got %d and %d", users, modules)
+	}
+}
+
+func TestReclassify(t *testing.T) {
+	oldRules, err := ParseRules(strings.NewReader("rules:\n" +
+		"  - prefix: /a/\n    category: other\n" +
+		"  - prefix: /b/\n    category: other\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing rules: %s", err)
+	}
+
+	newRules, err := ParseRules(strings.NewReader("rules:\n" +
+		"  - prefix: /a/\n    category: other\n" +
+		"  - prefix: /b/\n    category: apptainer\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing rules: %s", err)
+	}
+
+	db, err := NewDB(":memory:", newRules.Categories()...)
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	for n, event := range [...]struct {
+		Username, Command string
+		Time              int64
+	}{
+		{"userA", "/a/x", 1},
+		{"userA", "/b/y", 2},
+		{"userB", "/b/y", 3},
+		{"userB", "/b/z", 4},
+	} {
+		category, module := oldRules.Classify(event.Command)
+
+		if err := db.Add(event.Username, event.Command, category, module, "192.168.1.1", event.Time); err != nil {
+			t.Fatalf("test %d: unexpected error adding event: %s", n+1, err)
+		}
+	}
+
+	if _, err := db.db.Exec("INSERT INTO [events] (username, command, ip, time) VALUES ('userC', '/b/y', '192.168.1.1', 5);"); err != nil {
+		t.Fatalf("unexpected error adding legacy event: %s", err)
+	}
+
+	if table := dumpTable(t, db, "othermodules"); table != "x,userA,1,1,1\ny,userA,1,2,2\ny,userB,1,3,3\nz,userB,1,4,4\n" {
+		t.Errorf("unexpected othermodules table before reclassifying:\n%s", table)
+	}
+
+	if err := db.Reclassify(newRules.Classify, 3, 4, nil); err != nil {
+		t.Fatalf("unexpected error reclassifying events: %s", err)
+	}
+
+	if table := dumpTable(t, db, "othermodules"); table != "x,userA,1,1,1\ny,userA,1,2,2\nz,userB,1,4,4\n" {
+		t.Errorf("unexpected othermodules table after windowed reclassify:\n%s", table)
+	} else if table = dumpTable(t, db, "apptainermodules"); table != "y,userB,1,3,3\ny,userC,1,5,5\n" {
+		t.Errorf("unexpected apptainermodules table after windowed reclassify:\n%s", table)
+	}
+
+	var progress int
+
+	if err := db.Reclassify(newRules.Classify, 0, 0, func(n int) { progress = n }); err != nil {
+		t.Fatalf("unexpected error reclassifying events: %s", err)
+	}
+
+	if progress != 5 {
+		t.Errorf("expecting progress to report 5 events, got %d", progress)
+	}
+
+	if table := dumpTable(t, db, "othermodules"); table != "x,userA,1,1,1\n" {
+		t.Errorf("unexpected othermodules table after full reclassify:\n%s", table)
+	} else if table = dumpTable(t, db, "apptainermodules"); table != "y,userA,1,2,2\ny,userB,1,3,3\ny,userC,1,5,5\nz,userB,1,4,4\n" {
+		t.Errorf("unexpected apptainermodules table after full reclassify:\n%s", table)
+	}
+
+	if err := db.Add("userD", "/b/y", "apptainer", "y", "192.168.1.1", 6); err != nil {
+		t.Fatalf("unexpected error adding event after reclassify: %s", err)
+	}
+}
+
+func TestReclassifyRemovedCategory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := NewDB(path, "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	if err := db.Add("userA", "/foo/bar", "other", "foo/bar", "192.168.1.1", 1); err != nil {
+		t.Fatalf("unexpected error adding event: %s", err)
+	}
+
+	db.Close()
+
+	if db, err = NewDB(path, "apptainer"); err != nil {
+		t.Fatalf("unexpected error opening DB: %s", err)
+	}
+
+	defer db.Close()
+
+	if err := db.Reclassify(func(string) (string, string) { return "apptainer", "bar" }, 0, 0, nil); err != nil {
+		t.Fatalf("unexpected error reclassifying events: %s", err)
+	}
+
+	if table := dumpTable(t, db, "othermodules"); table != "" {
+		t.Errorf("expecting othermodules table to be emptied, got:\n%s", table)
+	} else if table = dumpTable(t, db, "apptainermodules"); table != "bar,userA,1,1,1\n" {
+		t.Errorf("unexpected apptainermodules table after reclassify:\n%s", table)
+	}
+}
+
+func TestAtomicAdd(t *testing.T) {
+	db, err := NewDB(":memory:", "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	if _, err := db.db.Exec("DROP TABLE [othermodules];"); err != nil {
+		t.Fatalf("unexpected error dropping table: %s", err)
+	}
+
+	if err := db.Add("userA", "some command", "other", "moduleA", "192.168.1.1", 1); err == nil {
+		t.Fatalf("expecting error adding event with missing module table")
+	}
+
+	if table := dumpTable(t, db, "events"); table != "" {
+		t.Errorf("expecting event to be rolled back, got:\n%s", table)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	db, err := NewDB(":memory:", "other", "softpack")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	for n, event := range [...]Event{
+		{Username: "userA", Command: "cmd", Time: 1, Category: "other", Module: "moduleA"},
+		{Username: "userA", Command: "cmd", Time: 2, Category: "other", Module: "moduleA"},
+		{Username: "userB", Command: "cmd", Time: 3, Category: "other", Module: "moduleB"},
+		{Username: "userB", Command: "cmd", Time: 4, Category: "softpack", Module: "envA"},
+	} {
+		if err := db.AddEvents([]Event{event}); err != nil {
+			t.Fatalf("test %d: unexpected error adding event: %s", n+1, err)
+		}
+	}
+
+	if drifts, unclassified, err := db.Verify(); err != nil {
+		t.Fatalf("unexpected error verifying: %s", err)
+	} else if len(drifts) != 0 || unclassified != 0 {
+		t.Fatalf("expecting no drift, got %v (%d unclassified)", drifts, unclassified)
+	}
+
+	for _, sql := range [...]string{
+		"UPDATE [othermodules] SET count = 5 WHERE module = 'moduleA';",
+		"DELETE FROM [othermodules] WHERE module = 'moduleB';",
+		"INSERT INTO [softpackmodules] (module, username, firstuse, lastuse) VALUES ('envB', 'userC', 9, 9);",
+	} {
+		if _, err := db.db.Exec(sql); err != nil {
+			t.Fatalf("unexpected error introducing drift: %s", err)
+		}
+	}
+
+	drifts, _, err := db.Verify()
+	if err != nil {
+		t.Fatalf("unexpected error verifying: %s", err)
+	}
+
+	var sb strings.Builder
+
+	for _, drift := range drifts {
+		fmt.Fprintf(&sb, "%s,%s,%s,%s,%s\n", drift.Category, drift.Module, drift.Username,
+			formatUsage(drift.Expected), formatUsage(drift.Actual))
+	}
+
+	const expected = "other,moduleA,userA,count=2 firstuse=1 lastuse=2,count=5 firstuse=1 lastuse=2\n" +
+		"other,moduleB,userB,count=1 firstuse=3 lastuse=3,nothing\n" +
+		"softpack,envB,userC,nothing,count=1 firstuse=9 lastuse=9\n"
+
+	if sb.String() != expected {
+		t.Errorf("expecting drift:\n%s\ngot:\n%s", expected, sb.String())
+	}
+
+	if err := db.Repair("other", "softpack"); err != nil {
+		t.Fatalf("unexpected error repairing: %s", err)
+	}
+
+	if drifts, _, err := db.Verify(); err != nil {
+		t.Fatalf("unexpected error verifying: %s", err)
+	} else if len(drifts) != 0 {
+		t.Errorf("expecting no drift after repair, got %v", drifts)
+	}
+}
+
+func TestVerifyRemovedCategory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := NewDB(path, "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	if err := db.Add("userA", "/foo/bar", "other", "foo/bar", "192.168.1.1", 1); err != nil {
+		t.Fatalf("unexpected error adding event: %s", err)
+	}
+
+	if _, err := db.db.Exec("UPDATE [events] SET category = 'ignore', module = '';"); err != nil {
+		t.Fatalf("unexpected error introducing drift: %s", err)
+	}
+
+	db.Close()
+
+	if db, err = NewDB(path, "apptainer"); err != nil {
+		t.Fatalf("unexpected error opening DB: %s", err)
+	}
+
+	defer db.Close()
+
+	drifts, _, err := db.Verify()
+	if err != nil {
+		t.Fatalf("unexpected error verifying: %s", err)
+	} else if len(drifts) != 1 || drifts[0].Category != "other" || drifts[0].Module != "foo/bar" || drifts[0].Expected != nil {
+		t.Fatalf("expecting stale row in othermodules to be reported, got %+v", drifts)
+	}
+
+	if err := db.Repair("other"); err != nil {
+		t.Fatalf("unexpected error repairing: %s", err)
+	} else if err := db.Repair("missing"); !errors.Is(err, ErrUnknownCategory) {
+		t.Errorf("expecting unknown category error repairing missing table, got %v", err)
+	}
+
+	if drifts, _, err := db.Verify(); err != nil {
+		t.Fatalf("unexpected error verifying: %s", err)
+	} else if len(drifts) != 0 {
+		t.Errorf("expecting no drift after repair, got %+v", drifts)
+	}
+}
+
 func dumpTable(t *testing.T, db *DB, table string) string {
 	t.Helper()
 
@@ -0,0 +1,149 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+func runExport(args []string) error {
+	flags := newFlagSet("export", "", "Exports the time, command, username and IP address of the events in the database "+
+		"as a TSV file, in the format read by import.")
+	output := flags.String("d", "", "db file")
+	file := flags.String("o", "-", "file to write to (- for stdout; gzip compressed if it ends in .gz)")
+	from := flags.String("from", "", "only export events at or after this time (YYYY-MM-DD [HH:MM:SS])")
+	to := flags.String("to", "", "only export events before this time (YYYY-MM-DD [HH:MM:SS])")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return ErrNoDatabase
+	}
+
+	start, err := parseTimeFlag(*from)
+	if err != nil {
+		return fmt.Errorf("invalid -from time: %w", err)
+	}
+
+	end, err := parseTimeFlag(*to)
+	if err != nil {
+		return fmt.Errorf("invalid -to time: %w", err)
+	}
+
+	db, err := OpenDBReadOnly(*output)
+	if err != nil {
+		return fmt.Errorf("error opening database (%s): %w", *output, err)
+	}
+
+	defer db.Close()
+
+	if *file == "-" {
+		return exportEvents(db, os.Stdout, start, end)
+	}
+
+	f, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+
+	if err = exportFile(db, f, strings.HasSuffix(*file, ".gz"), start, end); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+func exportFile(db *DB, f *os.File, compress bool, start, end int64) error {
+	if !compress {
+		return exportEvents(db, f, start, end)
+	}
+
+	gw := gzip.NewWriter(f)
+
+	if err := exportEvents(db, gw, start, end); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// exportEvents writes the events in the given time range, a zero end being
+// unbounded, as TSV rows of the time (in UTC), command, username and IP.
+func exportEvents(db *DB, w io.Writer, start, end int64) error {
+	rows, err := db.ReadEvents()
+	if err != nil {
+		return fmt.Errorf("error reading database: %w", err)
+	}
+
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	cw := csv.NewWriter(bw)
+	cw.Comma = '\t'
+
+	for rows.Next() {
+		var (
+			username, command, ip string
+			t                     int64
+		)
+
+		if err := rows.Scan(&username, &command, &ip, &t); err != nil {
+			return fmt.Errorf("error reading row: %w", err)
+		} else if t < start || end != 0 && t >= end {
+			continue
+		}
+
+		if err := cw.Write([]string{
+			time.Unix(t, 0).UTC().Format(time.DateTime), command, username, ip,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading database: %w", err)
+	}
+
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,202 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	db, err := NewDB(":memory:", "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	for n, event := range [...]struct {
+		Username, Command string
+		Time              int64
+	}{
+		{"userA", "/a/x", 1700000000},
+		{"userB", "/b/y", 1700000100},
+		{"userC", "/c/z", 1700000200},
+	} {
+		if err := db.Add(event.Username, event.Command, "", "", "192.168.1.1", event.Time); err != nil {
+			t.Fatalf("test %d: unexpected error adding event: %s", n+1, err)
+		}
+	}
+
+	for n, test := range [...]struct {
+		Start, End int64
+		Expected   string
+	}{
+		{
+			Expected: "2023-11-14 22:13:20\t/a/x\tuserA\t192.168.1.1\n" +
+				"2023-11-14 22:15:00\t/b/y\tuserB\t192.168.1.1\n" +
+				"2023-11-14 22:16:40\t/c/z\tuserC\t192.168.1.1\n",
+		},
+		{
+			Start:    1700000100,
+			Expected: "2023-11-14 22:15:00\t/b/y\tuserB\t192.168.1.1\n2023-11-14 22:16:40\t/c/z\tuserC\t192.168.1.1\n",
+		},
+		{
+			Start:    1700000000,
+			End:      1700000100,
+			Expected: "2023-11-14 22:13:20\t/a/x\tuserA\t192.168.1.1\n",
+		},
+	} {
+		var sb strings.Builder
+
+		if err := exportEvents(db, &sb, test.Start, test.End); err != nil {
+			t.Errorf("test %d: unexpected error exporting events: %s", n+1, err)
+		} else if out := sb.String(); out != test.Expected {
+			t.Errorf("test %d: expecting output %q, got %q", n+1, test.Expected, out)
+		}
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	dir := t.TempDir()
+	tsv := "2023-11-14 22:13:20\t/a/x\tuserA\t192.168.1.1\n2023-11-14 22:15:00\t/b/y\tuserB\t192.168.1.2\n"
+	input := filepath.Join(dir, "input.tsv")
+	output := filepath.Join(dir, "output.tsv.gz")
+	dbPath := filepath.Join(dir, "db")
+
+	if err := os.WriteFile(input, []byte(tsv), 0600); err != nil {
+		t.Fatalf("unexpected error writing input: %s", err)
+	}
+
+	if err := runImport([]string{"-d", dbPath}); !errors.Is(err, ErrImportSource) {
+		t.Errorf("expecting import source error, got %v", err)
+	}
+
+	if err := runImport([]string{"-d", dbPath, "-t", input, "-s", dbPath}); !errors.Is(err, ErrImportSource) {
+		t.Errorf("expecting import source error, got %v", err)
+	}
+
+	if err := runImport([]string{"-d", dbPath, "-t", input}); err != nil {
+		t.Fatalf("unexpected error importing: %s", err)
+	}
+
+	if err := runExport([]string{"-d", dbPath, "-o", output}); err != nil {
+		t.Fatalf("unexpected error exporting: %s", err)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("unexpected error opening output: %s", err)
+	}
+
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("unexpected error reading compressed output: %s", err)
+	}
+
+	if out, err := io.ReadAll(gr); err != nil {
+		t.Errorf("unexpected error reading output: %s", err)
+	} else if string(out) != tsv {
+		t.Errorf("expecting exported events %q, got %q", tsv, out)
+	}
+}
+
+func TestExportReportReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "legacy.db")
+	missing := filepath.Join(dir, "missing.db")
+
+	if err := runExport([]string{"-d", missing}); err == nil {
+		t.Errorf("expecting error exporting missing DB")
+	}
+
+	if err := runReport([]string{"-d", missing}); err == nil {
+		t.Errorf("expecting error reporting on missing DB")
+	}
+
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expecting missing DB not to be created, got %v", err)
+	}
+
+	legacy, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("unexpected error creating legacy DB: %s", err)
+	}
+
+	defer legacy.Close()
+
+	for _, stmt := range [...]string{
+		"CREATE TABLE [events] (username TEXT, command string, ip string, time INTEGER);",
+		"INSERT INTO [events] VALUES ('userA', '/apps/x', '192.168.1.1', 1700000000);",
+		"CREATE TABLE [othermodules] (module TEXT, username TEXT, count INTEGER, firstuse INTEGER, lastuse INTEGER);",
+		"INSERT INTO [othermodules] VALUES ('x', 'userA', 1, 1700000000, 1700000000);",
+	} {
+		if _, err := legacy.Exec(stmt); err != nil {
+			t.Fatalf("unexpected error creating legacy DB: %s", err)
+		}
+	}
+
+	if err := runExport([]string{"-d", dbPath, "-o", filepath.Join(dir, "out.tsv")}); err != nil {
+		t.Errorf("unexpected error exporting: %s", err)
+	}
+
+	if err := runReport([]string{"-d", dbPath, "-c", "other"}); err != nil {
+		t.Errorf("unexpected error reporting: %s", err)
+	}
+
+	if err := runReport([]string{"-d", dbPath, "-time", "sent"}); err == nil {
+		t.Errorf("expecting error with invalid -time")
+	}
+
+	var columns, tables int
+
+	if err := legacy.QueryRow("SELECT COUNT(*) FROM pragma_table_info('events');").Scan(&columns); err != nil {
+		t.Fatalf("unexpected error reading columns: %s", err)
+	} else if columns != 4 {
+		t.Errorf("expecting legacy DB to keep 4 columns, got %d", columns)
+	}
+
+	if err := legacy.QueryRow("SELECT COUNT(*) FROM sqlite_master;").Scan(&tables); err != nil {
+		t.Fatalf("unexpected error reading tables: %s", err)
+	} else if tables != 2 {
+		t.Errorf("expecting legacy DB to keep 2 tables, got %d", tables)
+	}
+
+	var mode string
+
+	if err := legacy.QueryRow("PRAGMA journal_mode;").Scan(&mode); err != nil {
+		t.Fatalf("unexpected error reading journal mode: %s", err)
+	} else if mode != "delete" {
+		t.Errorf("expecting legacy DB to keep its journal mode, got %q", mode)
+	}
+}
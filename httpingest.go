@@ -0,0 +1,215 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
+)
+
+const (
+	maxIngestBodySize = 1 << 20
+	maxIngestEvents   = 1000
+
+	// signatureHeader contains the signature of the request body, in the same
+	// <keyid>:<hex> form as the signature field of the extended protocol.
+	signatureHeader = "X-Signature"
+)
+
+var ErrInvalidEvent = errors.New("invalid event")
+
+// jsonEvent is a single event POSTed to the HTTP ingest endpoint.
+type jsonEvent struct {
+	Username string `json:"username"`
+	Command  string `json:"command"`
+	Time     int64  `json:"time"`
+	Hostname string `json:"hostname"`
+	Cwd      string `json:"cwd"`
+	JobID    string `json:"jobid"`
+	Version  string `json:"version"`
+}
+
+// eventStatus is the result of ingesting a single jsonEvent.
+type eventStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (e jsonEvent) payload() (analytics.Payload, error) {
+	p := analytics.Payload{
+		Username: strings.TrimSpace(e.Username),
+		Command:  strings.TrimSpace(e.Command),
+		Time:     e.Time,
+		Hostname: e.Hostname,
+		Cwd:      e.Cwd,
+		JobID:    e.JobID,
+		Version:  e.Version,
+	}
+
+	if p.Username == "" || p.Command == "" {
+		return p, fmt.Errorf("%w: missing username or command", ErrInvalidEvent)
+	} else if e.Time < 0 {
+		return p, fmt.Errorf("%w: negative time", ErrInvalidEvent)
+	}
+
+	size := 0
+
+	for _, field := range [...]string{p.Username, p.Command, p.Hostname, p.Cwd, p.JobID, p.Version} {
+		if strings.ContainsRune(field, 0) {
+			return p, fmt.Errorf("%w: fields must not contain NUL", ErrInvalidEvent)
+		}
+
+		size += len(field)
+	}
+
+	if size > maxPayloadSize {
+		return p, fmt.Errorf("%w: event larger than %d bytes", ErrInvalidEvent, maxPayloadSize)
+	}
+
+	return p, nil
+}
+
+// newIngestHandler returns a handler that accepts a single JSON event, or an
+// array of events, POSTed to it, responding with the status of each event.
+func newIngestHandler(in *ingester) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		ip := remoteIP(r)
+
+		if err := in.access.allow(ip); errors.Is(err, ErrRateLimited) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodySize))
+		if err != nil {
+			in.metrics.reject("read_error")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		flags, err := in.config.Auth.verifySignature(body, r.Header.Get(signatureHeader))
+		if err != nil {
+			in.metrics.reject(authReason(err))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		}
+
+		events, isArray, err := parseJSONEvents(body)
+		if err != nil {
+			in.metrics.reject("invalid_json")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		statuses := make([]eventStatus, len(events))
+
+		for n, event := range events {
+			statuses[n] = ingestJSONEvent(in, event, ip, flags)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if isArray {
+			json.NewEncoder(w).Encode(statuses) //nolint:errcheck
+		} else {
+			json.NewEncoder(w).Encode(statuses[0]) //nolint:errcheck
+		}
+	}
+}
+
+func parseJSONEvents(body []byte) ([]jsonEvent, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var events []jsonEvent
+
+		if err := dec.Decode(&events); err != nil {
+			return nil, true, err
+		} else if len(events) > maxIngestEvents {
+			return nil, true, fmt.Errorf("%w: more than %d events", ErrInvalidEvent, maxIngestEvents)
+		}
+
+		return events, true, nil
+	}
+
+	var event jsonEvent
+
+	if err := dec.Decode(&event); err != nil {
+		return nil, false, err
+	}
+
+	return []jsonEvent{event}, false, nil
+}
+
+func ingestJSONEvent(in *ingester, event jsonEvent, ip string, flags []string) eventStatus {
+	p, err := event.payload()
+	if err != nil {
+		in.metrics.reject("invalid_event")
+
+		return eventStatus{Status: "rejected", Error: err.Error()}
+	}
+
+	in.metrics.parsed.Inc()
+
+	if err := in.add(p, source{IP: ip}, flags...); err != nil {
+		return eventStatus{Status: "rejected", Error: err.Error()}
+	}
+
+	return eventStatus{Status: "accepted"}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
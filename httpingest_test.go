@@ -0,0 +1,132 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestHandler(t *testing.T) {
+	db, err := NewDB(":memory:", "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := ParseRules(strings.NewReader("rules:\n  - prefix: /opt/\n    category: other\n"))
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{MaxSkew: time.Minute, MaxAge: time.Hour, RejectSkew: true})
+	in.now = func() time.Time { return time.Unix(1000, 0) }
+
+	server := httptest.NewServer(newIngestHandler(in))
+
+	for n, test := range [...]struct {
+		Method         string
+		Body           string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{
+			http.MethodPost,
+			`{"username":"userA","command":"/opt/moduleA","time":100,"hostname":"node1","cwd":"/home/userA","jobid":"123","version":"1.0"}`,
+			http.StatusOK,
+			`{"status":"accepted"}`,
+		},
+		{
+			http.MethodPost,
+			`[{"username":"userB","command":"/opt/moduleB","time":200},{"username":"userC"},{"username":"userC","command":"/usr/bin/ls","time":300}]`,
+			http.StatusOK,
+			`[{"status":"accepted"},{"status":"rejected","error":"invalid event: missing username or command"},{"status":"accepted"}]`,
+		},
+		{
+			http.MethodPost,
+			`[{"username":"userD","command":"/opt/moduleD","time":2000},{"username":"userD","command":"/opt/moduleD"}]`,
+			http.StatusOK,
+			`[{"status":"rejected","error":"timestamp outside of allowed window: 2000"},{"status":"accepted"}]`,
+		},
+		{
+			http.MethodPost,
+			`{"username":"userA","command":"/opt/moduleA","ip":"10.0.0.1"}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			http.MethodPost,
+			`not json`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			http.MethodGet,
+			"",
+			http.StatusMethodNotAllowed,
+			"",
+		},
+	} {
+		req, err := http.NewRequest(test.Method, server.URL, strings.NewReader(test.Body))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error creating request: %s", n+1, err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error making request: %s", n+1, err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatalf("test %d: unexpected error reading response: %s", n+1, err)
+		}
+
+		if resp.StatusCode != test.ExpectedStatus {
+			t.Errorf("test %d: expecting status %d, got %d", n+1, test.ExpectedStatus, resp.StatusCode)
+		} else if test.ExpectedStatus == http.StatusOK && strings.TrimSpace(string(body)) != test.ExpectedBody {
+			t.Errorf("test %d: expecting body %s, got %s", n+1, test.ExpectedBody, body)
+		}
+	}
+
+	server.Close()
+	in.Close()
+
+	const expected = "userA,/opt/moduleA,127.0.0.1,100,other,moduleA,node1,/home/userA,123,1.0,1000,,<nil>,<nil>\n" +
+		"userB,/opt/moduleB,127.0.0.1,200,other,moduleB,,,,,1000,,<nil>,<nil>\n" +
+		"userC,/usr/bin/ls,127.0.0.1,300,ignore,,,,,,1000,,<nil>,<nil>\n" +
+		"userD,/opt/moduleD,127.0.0.1,1000,other,moduleD,,,,,1000,,<nil>,<nil>\n"
+
+	if table := dumpTable(t, db, "events"); table != expected {
+		t.Errorf("expecting events table to be:\n%s\ngot:\n%s", expected, table)
+	}
+}
@@ -0,0 +1,152 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// flagUserMismatch marks events whose claimed username differs from the
+	// username verified by the server.
+	flagUserMismatch = "user_mismatch"
+
+	identReplyLimit = 1024
+)
+
+var (
+	ErrIdentReply = errors.New("invalid ident reply")
+
+	// identPort is the port that ident servers listen on.
+	identPort = 113
+)
+
+// source is where a payload was received from: the IP address of the sender,
+// or unixSourcePrefix and a UID for Unix sockets, along with the username of
+// the sender when the server was able to verify it, and, for Unix sockets, the
+// PID of the sending process.
+type source struct {
+	IP           string
+	VerifiedUser string
+	PID          int32
+}
+
+// connSource returns the source of payloads received over the given
+// connection. The username of the sender is verified with SO_PEERCRED for Unix
+// sockets or, when identTimeout is positive, by asking the ident server on the
+// client host for TCP connections.
+func connSource(c net.Conn, identTimeout time.Duration) (source, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		src := source{IP: addrIP(c.RemoteAddr())}
+
+		if identTimeout > 0 {
+			src.VerifiedUser, _ = identLookup(c.LocalAddr(), c.RemoteAddr(), identTimeout) //nolint:errcheck
+		}
+
+		return src, nil
+	}
+
+	cred, err := peerCredentials(uc)
+	if err != nil {
+		return source{}, err
+	}
+
+	uid := strconv.FormatUint(uint64(cred.UID), 10)
+	src := source{IP: unixSourcePrefix + uid, VerifiedUser: uid, PID: cred.PID}
+
+	if u, err := user.LookupId(uid); err == nil {
+		src.VerifiedUser = u.Username
+	}
+
+	return src, nil
+}
+
+// identLookup asks the ident server (RFC 1413) on the remote host which user
+// owns the TCP connection between the given addresses.
+func identLookup(local, remote net.Addr, timeout time.Duration) (string, error) {
+	l, lok := local.(*net.TCPAddr)
+	r, rok := remote.(*net.TCPAddr)
+
+	if !lok || !rok {
+		return "", fmt.Errorf("%w: not a TCP connection", ErrIdentReply)
+	}
+
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(r.IP.String(), strconv.Itoa(identPort)), timeout)
+	if err != nil {
+		return "", err
+	}
+
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(timeout)) //nolint:errcheck
+
+	if _, err := fmt.Fprintf(c, "%d, %d\r\n", r.Port, l.Port); err != nil {
+		return "", err
+	}
+
+	line, err := bufio.NewReaderSize(c, identReplyLimit).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return parseIdentReply(line, r.Port, l.Port)
+}
+
+// parseIdentReply returns the user ID from a reply of the form
+// "<port>, <port> : USERID : <os> : <user>".
+func parseIdentReply(line string, remotePort, localPort int) (string, error) {
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(parts) < 3 {
+		return "", fmt.Errorf("%w: %q", ErrIdentReply, line)
+	}
+
+	var rp, lp int
+
+	if _, err := fmt.Sscanf(strings.ReplaceAll(parts[0], " ", ""), "%d,%d", &rp, &lp); err != nil ||
+		rp != remotePort || lp != localPort {
+		return "", fmt.Errorf("%w: unexpected ports %q", ErrIdentReply, parts[0])
+	}
+
+	if strings.TrimSpace(parts[1]) != "USERID" || len(parts) != 4 {
+		return "", fmt.Errorf("%w: %s", ErrIdentReply, strings.TrimSpace(parts[len(parts)-1]))
+	}
+
+	username := strings.TrimSpace(parts[3])
+	if username == "" {
+		return "", fmt.Errorf("%w: empty user ID", ErrIdentReply)
+	}
+
+	return username, nil
+}
@@ -0,0 +1,133 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIdentReply(t *testing.T) {
+	for n, test := range [...]struct {
+		Reply, Username string
+		Error           bool
+	}{
+		{"6193, 23 : USERID : UNIX : userA\r\n", "userA", false},
+		{"6193,23:USERID:UNIX,UTF-8:userB\r\n", "userB", false},
+		{"6193, 23 : USERID : UNIX : user:C\r\n", "user:C", false},
+		{"6193, 23 : ERROR : NO-USER\r\n", "", true},
+		{"6193, 24 : USERID : UNIX : userA\r\n", "", true},
+		{"6193, 23 : USERID : UNIX : \r\n", "", true},
+		{"garbage\r\n", "", true},
+	} {
+		username, err := parseIdentReply(test.Reply, 6193, 23)
+		if test.Error {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got username %q", n+1, username)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if username != test.Username {
+			t.Errorf("test %d: expecting username %q, got %q", n+1, test.Username, username)
+		}
+	}
+}
+
+func TestIdentVerification(t *testing.T) {
+	identd, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating ident listener: %s", err)
+	}
+
+	defer identd.Close()
+
+	oldPort := identPort
+	identPort = identd.Addr().(*net.TCPAddr).Port //nolint:forcetypeassert
+
+	defer func() { identPort = oldPort }()
+
+	go serveTestIdent(identd, "USER_A")
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	defer l.Close()
+
+	go newAnalyticsServer(l, newIngester(db, rules, newMetrics(db), ingestConfig{Ident: time.Second})) //nolint:errcheck
+
+	for _, username := range [...]string{"USER_A", "USER_B"} {
+		c := dialTest(t, l)
+
+		io.WriteString(c, username+"\x00/path/to/command") //nolint:errcheck
+		c.Close()
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	out := dumpTable(t, db, "events")
+
+	for _, expected := range [...]string{
+		",,USER_A,<nil>\n",
+		"," + flagUserMismatch + ",USER_A,<nil>\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expecting events table to contain %q, got %q", expected, out)
+		}
+	}
+}
+
+// serveTestIdent answers ident queries with the given username.
+func serveTestIdent(l net.Listener, username string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		line, _ := bufio.NewReader(c).ReadString('\n') //nolint:errcheck
+
+		fmt.Fprintf(c, "%s : USERID : UNIX : %s\r\n", strings.TrimSpace(line), username)
+		c.Close()
+	}
+}
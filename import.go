@@ -0,0 +1,300 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrImportSource   = errors.New("exactly one of -t and -s must be given")
+	ErrSourceDatabase = errors.New("invalid database to import")
+)
+
+func runImport(args []string) error {
+	flags := newFlagSet("import", "", "Imports the events in a TSV file, as written by earlier versions of this program "+
+		"or by export, or in another database, into a database, skipping events that are already in it.")
+	output := flags.String("d", "", "db file")
+	tsv := flags.String("t", "", "TSV file to import (- for stdin; gzip compressed if it ends in .gz)")
+	sqlite := flags.String("s", "", "database to import")
+	rulesFile := flags.String("r", "", "classification rules file")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return ErrNoDatabase
+	} else if (*tsv == "") == (*sqlite == "") {
+		return ErrImportSource
+	}
+
+	rules, err := LoadRules(*rulesFile)
+	if err != nil {
+		return fmt.Errorf("error loading rules: %w", err)
+	}
+
+	db, err := NewDB(*output, rules.Categories()...)
+	if err != nil {
+		return fmt.Errorf("error opening database (%s): %w", *output, err)
+	}
+
+	defer db.Close()
+
+	imp := &importer{db: db, rules: rules}
+
+	slog.Info("Importing…")
+
+	if *tsv != "" {
+		err = importData(imp, *tsv)
+	} else {
+		err = importDB(imp, *sqlite)
+	}
+
+	if err == nil {
+		err = imp.flush()
+	}
+
+	fmt.Println()
+
+	if err != nil {
+		return fmt.Errorf("error importing data: %w", err)
+	}
+
+	slog.Info("…Done", "read", imp.read, "added", imp.added)
+
+	return nil
+}
+
+// importer classifies events and adds them, in batches, to a database that may
+// already contain events, skipping any that it already has, so that importing
+// the same events again has no effect.
+type importer struct {
+	db    *DB
+	rules *RuleSet
+	batch []Event
+
+	read, added int
+}
+
+func (i *importer) add(e Event) error {
+	e.Category, e.Module = i.rules.Classify(e.Command)
+	i.batch = append(i.batch, e)
+	i.read++
+
+	if len(i.batch) < defaultBatchSize {
+		return nil
+	}
+
+	return i.flush()
+}
+
+// flush writes the batched events in a single transaction, which is kept short
+// so that a server writing to the same database is not blocked for long.
+func (i *importer) flush() error {
+	if len(i.batch) == 0 {
+		return nil
+	}
+
+	added, err := i.db.ImportEvents(i.batch)
+	if err != nil {
+		return fmt.Errorf("error adding to database: %w", err)
+	}
+
+	i.added += added
+	i.batch = i.batch[:0]
+
+	fmt.Printf("\r%d", i.read)
+
+	return nil
+}
+
+func importData(imp *importer, path string) error {
+	var r io.Reader
+
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		if strings.HasSuffix(path, ".gz") {
+			if r, err = gzip.NewReader(f); err != nil {
+				return fmt.Errorf("failed to read gzip compressed input: %w", err)
+			}
+		} else {
+			r = f
+		}
+	}
+
+	return readCSV(csv.NewReader(r), imp)
+}
+
+func readCSV(reader *csv.Reader, imp *importer) error {
+	reader.Comma = '\t'
+
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if len(row) < 4 {
+			continue
+		}
+
+		date, command, user, ip := row[0], row[1], row[2], row[3]
+
+		d, err := time.Parse(time.DateTime, date)
+		if err != nil {
+			continue
+		}
+
+		if err := imp.add(Event{Username: user, Command: command, IP: ip, Time: d.Unix()}); err != nil {
+			return err
+		}
+	}
+}
+
+// sourceColumns are the columns read from the events table of an imported
+// database, with the values used for those it does not have, as databases
+// created by earlier versions lack the later columns. Columns without a default
+// are required.
+var sourceColumns = [...][2]string{
+	{"username", ""},
+	{"command", ""},
+	{"ip", ""},
+	{"time", ""},
+	{"hostname", "''"},
+	{"cwd", "''"},
+	{"jobid", "''"},
+	{"version", "''"},
+	{"received", "0"},
+	{"flags", "''"},
+	{"verified_username", "''"},
+}
+
+// importDB imports the events in the database at the given path, keeping their
+// details, such as hostname and flags, but reclassifying them. The database is
+// opened read-only, so that its schema is left as it is.
+func importDB(imp *importer, path string) error {
+	uri, err := readOnlyURI(path)
+	if err != nil {
+		return fmt.Errorf("error opening input database: %w", err)
+	}
+
+	in, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return fmt.Errorf("error opening input database: %w", err)
+	}
+
+	defer in.Close()
+
+	query, err := sourceQuery(in)
+	if err != nil {
+		return err
+	}
+
+	rows, err := in.Query(query)
+	if err != nil {
+		return fmt.Errorf("error reading database: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Event
+
+		if err := rows.Scan(&e.Username, &e.Command, &e.IP, &e.Time, &e.Hostname, &e.Cwd, &e.JobID, &e.Version,
+			&e.Received, &e.Flags, &e.VerifiedUsername); err != nil {
+			return fmt.Errorf("error reading row: %w", err)
+		}
+
+		if err := imp.add(e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// sourceQuery returns a query that selects the sourceColumns from the events
+// table of the given database, substituting defaults for those it lacks.
+func sourceQuery(db *sql.DB) (string, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('events');")
+	if err != nil {
+		return "", fmt.Errorf("error reading columns of input database: %w", err)
+	}
+
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return "", fmt.Errorf("error reading columns of input database: %w", err)
+		}
+
+		existing[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("error reading columns of input database: %w", err)
+	}
+
+	columns := make([]string, len(sourceColumns))
+
+	for n, column := range sourceColumns {
+		switch {
+		case existing[column[0]] && column[1] == "":
+			columns[n] = column[0]
+		case existing[column[0]]:
+			columns[n] = "COALESCE(" + column[0] + ", " + column[1] + ")"
+		case column[1] == "":
+			return "", fmt.Errorf("%w: no %s column in events table", ErrSourceDatabase, column[0])
+		default:
+			columns[n] = column[1]
+		}
+	}
+
+	return "SELECT " + strings.Join(columns, ", ") + " FROM [events];", nil
+}
@@ -0,0 +1,174 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "analytics.db")
+	rulesPath := filepath.Join(dir, "rules.yml")
+	tsvPath := filepath.Join(dir, "events.tsv")
+	otherPath := filepath.Join(dir, "other.db")
+
+	if err := os.WriteFile(rulesPath, []byte("rules:\n  - prefix: /apps/\n    category: other\n"), 0600); err != nil {
+		t.Fatalf("unexpected error writing rules: %s", err)
+	}
+
+	if err := os.WriteFile(tsvPath, []byte("2023-11-14 22:13:20\t/apps/x\tuserA\t192.168.1.1\n"+
+		"2023-11-14 22:15:00\t/apps/x\tuserB\t192.168.1.2\n"+
+		"2023-11-14 22:15:00\t/apps/x\tuserB\t192.168.1.2\n"+
+		"2023-11-14 22:16:40\t/apps/y\tuserB\t192.168.1.2\n"), 0600); err != nil {
+		t.Fatalf("unexpected error writing TSV: %s", err)
+	}
+
+	db, err := NewDB(dbPath, "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	if err := db.Add("userA", "/apps/x", "other", "x", "192.168.1.1", 1700000000); err != nil {
+		t.Fatalf("unexpected error adding event: %s", err)
+	}
+
+	db.Close()
+
+	other, err := NewDB(otherPath)
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	if err := other.AddEvents([]Event{
+		{Username: "userB", Command: "/apps/y", IP: "192.168.1.2", Time: 1700000200},
+		{Username: "userC", Command: "/apps/y", IP: "192.168.1.3", Time: 1700000300, Hostname: "node1", JobID: "123",
+			Received: 1700000301, Flags: "skew", VerifiedUsername: "userC"},
+	}); err != nil {
+		t.Fatalf("unexpected error adding events: %s", err)
+	}
+
+	other.Close()
+
+	const (
+		expectedEvents = "userA,/apps/x,192.168.1.1,1700000000,other,x,,,,,<nil>,,<nil>,<nil>\n" +
+			"userB,/apps/x,192.168.1.2,1700000100,other,x,,,,,<nil>,,<nil>,<nil>\n" +
+			"userB,/apps/y,192.168.1.2,1700000200,other,y,,,,,<nil>,,<nil>,<nil>\n" +
+			"userC,/apps/y,192.168.1.3,1700000300,other,y,node1,,123,,1700000301,skew,userC,<nil>\n"
+		expectedModules = "x,userA,1,1700000000,1700000000\n" +
+			"x,userB,1,1700000100,1700000100\n" +
+			"y,userB,1,1700000200,1700000200\n" +
+			"y,userC,1,1700000300,1700000300\n"
+	)
+
+	for n := 0; n < 2; n++ {
+		if err := runImport([]string{"-d", dbPath, "-r", rulesPath, "-t", tsvPath}); err != nil {
+			t.Fatalf("import %d: unexpected error importing TSV: %s", n+1, err)
+		}
+
+		if err := runImport([]string{"-d", dbPath, "-r", rulesPath, "-s", otherPath}); err != nil {
+			t.Fatalf("import %d: unexpected error importing DB: %s", n+1, err)
+		}
+
+		if db, err = NewDB(dbPath, "other"); err != nil {
+			t.Fatalf("import %d: unexpected error opening DB: %s", n+1, err)
+		}
+
+		if table := dumpTable(t, db, "events"); table != expectedEvents {
+			t.Errorf("import %d: expecting events table:\n%s\ngot:\n%s", n+1, expectedEvents, table)
+		}
+
+		if table := dumpTable(t, db, "othermodules"); table != expectedModules {
+			t.Errorf("import %d: expecting othermodules table:\n%s\ngot:\n%s", n+1, expectedModules, table)
+		}
+
+		db.Close()
+	}
+}
+
+func TestImportLegacyDB(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "analytics.db")
+	legacyPath := filepath.Join(dir, "legacy.db")
+
+	legacy, err := sql.Open("sqlite3", legacyPath)
+	if err != nil {
+		t.Fatalf("unexpected error creating legacy DB: %s", err)
+	}
+
+	for _, stmt := range [...]string{
+		"CREATE TABLE [events] (username TEXT, command string, ip string, time INTEGER);",
+		"INSERT INTO [events] VALUES ('userA', '/apps/x', '192.168.1.1', 1700000000);",
+	} {
+		if _, err := legacy.Exec(stmt); err != nil {
+			t.Fatalf("unexpected error creating legacy DB: %s", err)
+		}
+	}
+
+	legacy.Close()
+
+	if err := runImport([]string{"-d", dbPath, "-s", legacyPath}); err != nil {
+		t.Fatalf("unexpected error importing legacy DB: %s", err)
+	}
+
+	if legacy, err = sql.Open("sqlite3", legacyPath); err != nil {
+		t.Fatalf("unexpected error opening legacy DB: %s", err)
+	}
+
+	defer legacy.Close()
+
+	var columns int
+
+	if err := legacy.QueryRow("SELECT COUNT(*) FROM pragma_table_info('events');").Scan(&columns); err != nil {
+		t.Fatalf("unexpected error reading columns: %s", err)
+	} else if columns != 4 {
+		t.Errorf("expecting legacy DB to keep 4 columns, got %d", columns)
+	}
+
+	var mode string
+
+	if err := legacy.QueryRow("PRAGMA journal_mode;").Scan(&mode); err != nil {
+		t.Fatalf("unexpected error reading journal mode: %s", err)
+	} else if mode != "delete" {
+		t.Errorf("expecting legacy DB to keep its journal mode, got %q", mode)
+	}
+
+	db, err := NewDB(dbPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening DB: %s", err)
+	}
+
+	defer db.Close()
+
+	if table, expected := dumpTable(t, db, "events"),
+		"userA,/apps/x,192.168.1.1,1700000000,ignore,,,,,,<nil>,,<nil>,<nil>\n"; table != expected {
+		t.Errorf("expecting events table %q, got %q", expected, table)
+	}
+}
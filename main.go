@@ -28,8 +28,9 @@
 package main
 
 import (
-	"compress/gzip"
-	"encoding/csv"
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -39,301 +40,486 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
+)
+
+var (
+	ErrNoSubcommand      = errors.New("no command given")
+	ErrUnknownSubcommand = errors.New("unknown command")
 )
 
 func main() {
-	if err := run(); err != nil {
+	if err := run(); err != nil && !errors.Is(err, flag.ErrHelp) {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// command is a subcommand of the program.
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands = [...]command{
+	{"serve", "Receive events and record them in a database, or relay them upstream.", runServe},
+	{"import", "Import events from a TSV file or another database into a database.", runImport},
+	{"export", "Export the events in a database as a TSV file.", runExport},
+	{"report", "Print the most used modules in each category of a database.", runReport},
+	{"reclassify", "Reclassify the events in a database with new rules.", runReclassify},
+	{"verify", "Check, and optionally repair, the module tables of a database.", runVerify},
+	{"send", "Send a single event to a server.", runSend},
+}
+
 func run() error {
-	port := flag.Uint64("p", 1234, "port to listen on for analytics")
-	output := flag.String("d", "", "db file")
-	tsv := flag.String("t", "", "import file")
-	sqlite := flag.String("s", "", "import database")
-	flag.Parse()
-
-	if *tsv != "" {
-		if err := importAndSaveData(*tsv, *output); err != nil {
-			return err
-		}
-	} else if *sqlite != "" {
-		if err := importDBAndSaveData(*sqlite, *output); err != nil {
-			return err
-		}
+	if len(os.Args) < 2 {
+		usage()
+
+		return ErrNoSubcommand
 	}
 
-	al, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(*port)})
-	if err != nil {
-		return err
+	name, args := os.Args[1], os.Args[2:]
+
+	switch name {
+	case "help", "-h", "-help", "--help":
+		usage()
+
+		return nil
 	}
 
-	db, err := NewDB(*output)
-	if err != nil {
-		return fmt.Errorf("error opening database (%s): %w", *output, err)
+	if strings.HasPrefix(name, "-") {
+		slog.Warn("running without a subcommand is deprecated; use serve")
+
+		return runServe(os.Args[1:])
 	}
 
-	slog.Info("Server Started…")
-	defer slog.Info("…Server Stopped")
-	defer db.Close()
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(args)
+		}
+	}
 
-	return newAnalyticsServer(al, db)
+	usage()
+
+	return fmt.Errorf("%w: %q", ErrUnknownSubcommand, name)
 }
 
-func newAnalyticsServer(al *net.TCPListener, db *DB) error {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
 
-	go func() {
-		sig := make(chan os.Signal, 1)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s%s\n", c.name, c.description)
+	}
 
-		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", filepath.Base(os.Args[0]))
+}
 
-		<-sig
+// newFlagSet returns a flag set for the named subcommand, whose usage message
+// shows the given arguments and description.
+func newFlagSet(name, args, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
 
-		al.Close()
-	}()
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]%s\n\n%s\n\nFlags:\n",
+			filepath.Base(os.Args[0]), name, args, description)
+		flags.PrintDefaults()
+	}
 
-	for {
-		c, err := al.AcceptTCP()
+	return flags
+}
+
+// listenSockets opens the sockets given on the command line, wrapping the TCP
+// listener with the given function; zero ports and empty paths or addresses are
+// not listened on.
+func listenSockets(port, udpPort uint64, unixPath, unixMode, httpAddr string,
+	wrapTCP func(net.Listener) net.Listener) (*sockets, error) {
+	s := new(sockets)
+
+	if port != 0 {
+		tl, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(port)})
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		wg.Add(1)
-
-		go handleAnalytics(c, db, &wg)
+		s.Stream = append(s.Stream, wrapTCP(tl))
 	}
-}
 
-func handleAnalytics(c *net.TCPConn, db *DB, wg *sync.WaitGroup) {
-	defer wg.Done()
+	if unixPath != "" {
+		ul, err := listenUnix(unixPath, unixMode)
+		if err != nil {
+			return nil, fmt.Errorf("error listening on Unix socket: %w", err)
+		}
 
-	var sb strings.Builder
+		s.Stream = append(s.Stream, ul)
+	}
 
-	if _, err := io.Copy(&sb, io.LimitReader(c, 4096)); err != nil {
-		return
+	if udpPort != 0 {
+		uc, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(udpPort)})
+		if err != nil {
+			return nil, err
+		}
+
+		s.UDP = append(s.UDP, uc)
 	}
 
-	parts := strings.Split(sb.String(), "\x00")
+	if httpAddr != "" {
+		l, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("error starting HTTP server: %w", err)
+		}
 
-	if len(parts) != 2 {
-		return
+		s.HTTP = l
 	}
 
-	username := strings.TrimSpace(parts[0])
-	command := strings.TrimSpace(parts[1])
-	ip := c.RemoteAddr().(*net.TCPAddr).IP
+	return s, nil
+}
 
-	if err := addToDB(db, username, command, ip.String(), time.Now().Unix()); err != nil {
-		slog.Error("error writing to database", "err", err)
+// closeOnSignal closes the given listeners when the process is asked to stop.
+func closeOnSignal(closers ...io.Closer) {
+	sig := make(chan os.Signal, 1)
+
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sig
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		slog.Warn("error notifying systemd", "err", err)
+	}
+
+	for _, c := range closers {
+		c.Close()
 	}
 }
 
-func addToDB(db *DB, username, command, ip string, now int64) error {
-	adder := db.AddEvent
-	var module string
+// serveListeners accepts connections on all of the given listeners until one of
+// them fails, at which point the rest are closed. The connection limits apply
+// to the connections of all of the listeners together.
+func serveListeners(in *ingester, listeners ...net.Listener) error {
+	conns := newConnTracker(in.config.Conns, in.metrics)
+	defer conns.drain()
+
+	errs := make(chan error, len(listeners))
 
-	mod := moduleFromCommand(command)
-	switch mod := mod.(type) {
-	case SoftPackModule:
-		adder = db.AddSoftpack
-		module = string(mod)
-	case CondaModule:
-		adder = db.AddConda
-		module = string(mod)
-	case OtherModule:
-		adder = db.AddOther
-		module = string(mod)
+	for _, l := range listeners {
+		go func(l net.Listener) { errs <- acceptConns(l, in, conns) }(l)
 	}
 
-	if err := adder(username, command, module, ip, now); err != nil {
-		return err
+	err := <-errs
+
+	for _, l := range listeners {
+		l.Close()
 	}
 
-	return nil
+	for range listeners[1:] {
+		<-errs
+	}
+
+	return err
 }
 
-type SoftPackModule string
+// newAnalyticsServer accepts connections on the listener until it is closed.
+func newAnalyticsServer(al net.Listener, in *ingester) error {
+	return serveListeners(in, al)
+}
 
-type CondaModule string
+// acceptConns accepts connections on the listener, within the limits of the
+// tracker, until it is closed.
+func acceptConns(al net.Listener, in *ingester, conns *connTracker) error {
+	for {
+		conns.reserve()
 
-type OtherModule string
+		c, err := al.Accept()
+		if err != nil {
+			conns.unreserve()
 
-func moduleFromCommand(command string) any {
-	if command == "/software/hgi/installs/conda-audited/miniconda/bin/conda shell.bash hook" {
-		return ""
-	}
+			return err
+		}
+
+		if !conns.add(c) {
+			c.Close()
 
-	if strings.HasPrefix(command, "/software/hgi/installs/conda-audited/miniconda/bin/conda shell.posix activate ") {
-		if pos := strings.Index(command, "/.snakemake/conda/"); pos != -1 {
-			command = command[:pos]
+			continue
 		}
 
-		return CondaModule(strings.TrimPrefix(command, "/software/hgi/installs/conda-audited/miniconda/bin/conda shell.posix activate "))
+		go func() {
+			defer conns.done(c)
+
+			handleAnalytics(c, in)
+		}()
 	}
+}
 
-	if strings.HasPrefix(command, "/software/hgi/installs/conda-audited/miniforge/bin/conda shell.posix activate ") {
-		if pos := strings.Index(command, "/.snakemake/conda/"); pos != -1 {
-			command = command[:pos]
-		}
+// handleAnalytics reads payloads from the connection, after checking that its
+// source is allowed to send them.
+func handleAnalytics(c net.Conn, in *ingester) {
+	defer c.Close()
 
-		return CondaModule(strings.TrimPrefix(command, "/software/hgi/installs/conda-audited/miniforge/bin/conda shell.posix activate "))
+	if err := proxyHeaderErr(c); err != nil {
+		in.metrics.reject("proxy_header")
+
+		return
+	} else if !isUnixConn(c) && in.access.allow(addrIP(c.RemoteAddr())) != nil {
+		return
 	}
 
-	if strings.HasPrefix(command, "/software/hgi/installs/conda-audited/") {
-		return OtherModule("conda-audited")
+	in.metrics.connections.Inc()
+
+	start := time.Now()
+	defer func() { in.metrics.handleDuration.Observe(since(start)) }()
+
+	timeout := in.config.Conns.ReadTimeout
+
+	if tc, ok := c.(*tls.Conn); ok {
+		if timeout > 0 {
+			c.SetDeadline(time.Now().Add(timeout)) //nolint:errcheck
+		}
+
+		if err := tc.Handshake(); err != nil {
+			in.metrics.reject("tls_handshake")
+
+			return
+		}
+
+		c.SetDeadline(time.Time{}) //nolint:errcheck
 	}
 
-	if strings.HasPrefix(command, "/software/hgi/installs/micromamba/micromamba") {
-		return OtherModule("micromamba")
+	src, err := connSource(c, in.config.Ident)
+	if err != nil {
+		in.metrics.reject("peer_credentials")
+
+		return
 	}
 
-	module := filepath.Dir(command)
+	r := bufio.NewReaderSize(withReadTimeout(c, timeout), maxPayloadSize)
+
+	if framed, err := isFramed(r); err != nil {
+		in.metrics.reject(readErrorReason(err))
 
-	if strings.HasPrefix(module, "/software/hgi/softpack/installs/") {
-		return SoftPackModule(strings.TrimPrefix(strings.TrimSuffix(module, "-scripts"), "/software/hgi/softpack/installs/"))
+		return
+	} else if framed {
+		readRecords(r, src, in)
+
+		return
 	}
 
-	if strings.HasPrefix(module, "/software/hgi/installs/") {
-		return OtherModule(strings.TrimPrefix(strings.TrimSuffix(module, "-scripts"), "/software/hgi/installs/"))
+	var sb strings.Builder
+
+	if _, err := io.Copy(&sb, io.LimitReader(r, maxPayloadSize)); err != nil {
+		in.metrics.reject(readErrorReason(err))
+
+		return
 	}
 
-	return module
+	in.ingest(sb.String(), src)
 }
 
-func importAndSaveData(tsv, output string) error {
-	db, err := NewDB(":memory:")
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		return fmt.Errorf("error opening in-memory db: %w", err)
-	}
-
-	slog.Info("Importing…")
-	if err := importData(db, tsv); err != nil {
-		return fmt.Errorf("error importing data: %w", err)
+		return addr.String()
 	}
 
-	slog.Info("Exporting…")
+	return host
+}
 
-	if err := db.SaveTo(output); err != nil {
-		return fmt.Errorf("error exporting in-memory db to disk: %w", err)
+// isFramed returns true when the connection begins with an extended payload,
+// in which case it may contain many records.
+func isFramed(r *bufio.Reader) (bool, error) {
+	magic, err := r.Peek(len(analytics.ProtocolMagic) + 1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
 	}
 
-	slog.Info("…Done")
-
-	return nil
+	return string(magic) == analytics.ProtocolMagic+"\x00", nil
 }
 
-func importData(db *DB, path string) error {
-	var r io.Reader
+// readRecords reads payloads separated by analytics.RecordSeparator until the connection
+// is closed.
+func readRecords(r io.Reader, src source, in *ingester) {
+	sc := bufio.NewScanner(r)
 
-	if path == "-" {
-		r = os.Stdin
-	} else {
-		f, err := os.Open(path)
-		if err != nil {
-			return err
-		}
+	sc.Buffer(make([]byte, 0, maxPayloadSize), maxPayloadSize)
+	sc.Split(splitRecords)
 
-		defer f.Close()
-
-		if strings.HasSuffix(path, ".gz") {
-			if r, err = gzip.NewReader(f); err != nil {
-				return fmt.Errorf("failed to read gzip compressed input: %w", err)
-			}
-		} else {
-			r = f
+	for sc.Scan() {
+		if record := strings.TrimSpace(sc.Text()); record != "" {
+			in.ingest(record, src)
 		}
 	}
 
-	return readCSVIntoDB(csv.NewReader(r), db)
+	if errors.Is(sc.Err(), bufio.ErrTooLong) {
+		in.metrics.reject("too_large")
+	} else if sc.Err() != nil {
+		in.metrics.reject(readErrorReason(sc.Err()))
+	}
 }
 
-func readCSVIntoDB(reader *csv.Reader, db *DB) error {
-	reader.Comma = '\t'
-	count := 0
+func splitRecords(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, analytics.RecordSeparator); i >= 0 {
+		return i + 1, data[:i], nil
+	}
 
-	for {
-		row, err := reader.Read()
-		if errors.Is(err, io.EOF) {
-			fmt.Printf("\r%d\n", count)
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
 
-			return nil
-		} else if err != nil {
-			return err
-		} else if len(row) < 4 {
-			continue
-		}
+	return 0, nil, nil
+}
 
-		date, command, user, ip := row[0], row[1], row[2], row[3]
+const (
+	defaultMaxSkew = 5 * time.Minute
+	defaultMaxAge  = 7 * 24 * time.Hour
 
-		d, err := time.Parse(time.DateTime, date)
-		if err != nil {
-			continue
-		} else if err = addToDB(db, user, command, ip, d.Unix()); err != nil {
-			return fmt.Errorf("error adding to database: %w", err)
-		}
+	// flagSkew marks events whose client timestamp is outside of the skew
+	// window.
+	flagSkew = "skew"
+)
 
-		count++
+var ErrClockSkew = errors.New("timestamp outside of allowed window")
+
+// ingestConfig configures an ingester. A zero MaxSkew or MaxAge disables the
+// corresponding check of client timestamps.
+type ingestConfig struct {
+	Queue      queueConfig
+	MaxSkew    time.Duration
+	MaxAge     time.Duration
+	RejectSkew bool
+	Auth       authenticator
+	Access     accessConfig
+	Conns      connConfig
+
+	// Ident is how long to wait for the ident server on the host of a TCP
+	// client when verifying its username; lookups are disabled if zero.
+	Ident time.Duration
+}
 
-		if count%1000 == 0 {
-			fmt.Printf("\r%d", count)
-		}
+// ingester classifies received events and queues them to be written to the
+// database, keeping metrics of what it does.
+type ingester struct {
+	rules   *RuleSet
+	metrics *metrics
+	queue   *writeQueue
+	access  *accessControl
+	config  ingestConfig
+	now     func() time.Time
+}
+
+func newIngester(db eventWriter, rules *RuleSet, m *metrics, config ingestConfig) *ingester {
+	return &ingester{
+		rules:   rules,
+		metrics: m,
+		queue:   newWriteQueue(db, m, config.Queue),
+		access:  newAccessControl(config.Access, m),
+		config:  config,
+		now:     time.Now,
 	}
 }
 
-func importDBAndSaveData(db, path string) error {
-	in, err := NewDB(db)
+// ingest checks the signature of, parses and adds a single payload received
+// from the given source.
+func (i *ingester) ingest(data string, src source) {
+	data, flags, err := i.config.Auth.verifyPayload(data)
 	if err != nil {
-		return fmt.Errorf("error opening input database: %w", err)
+		i.metrics.reject(authReason(err))
+
+		return
 	}
 
-	out, err := NewDB(":memory:")
+	p, err := analytics.ParsePayload(data)
 	if err != nil {
-		return fmt.Errorf("error opening memory database: %w", err)
+		i.metrics.reject("malformed")
+
+		return
 	}
 
-	rows, err := in.ReadEvents()
-	if err != nil {
-		return fmt.Errorf("error reading database: %w", err)
+	i.metrics.parsed.Inc()
+
+	i.add(p, src, flags...) //nolint:errcheck
+}
+
+func authReason(err error) string {
+	if errors.Is(err, ErrUnsigned) {
+		return "unsigned"
 	}
 
-	defer rows.Close()
+	return "bad_signature"
+}
 
-	count := 0
+// add classifies and queues the payload, with the given flags. Payloads without
+// a client timestamp are recorded at the time they are received; those with a
+// timestamp outside of the configured window are either flagged or rejected
+// with ErrClockSkew. Payloads claiming a username other than the one verified
+// for the source are flagged.
+func (i *ingester) add(p analytics.Payload, src source, flags ...string) error {
+	received := i.now().Unix()
+
+	e := Event{
+		Username: p.Username,
+		Command:  p.Command,
+		IP:       src.IP,
+		Time:     p.Time,
+		Received: received,
+		Hostname: p.Hostname,
+		Cwd:      p.Cwd,
+		JobID:    p.JobID,
+		Version:  p.Version,
+
+		VerifiedUsername: src.VerifiedUser,
+	}
 
-	for rows.Next() {
-		var (
-			username, command, ip string
-			now                   int64
-		)
+	if e.Time == 0 {
+		e.Time = received
+	} else if i.isSkewed(e.Time, received) {
+		if i.config.RejectSkew {
+			i.metrics.reject(flagSkew)
 
-		if err := rows.Scan(&username, &command, &ip, &now); err != nil {
-			return fmt.Errorf("error reading row: %w", err)
+			return fmt.Errorf("%w: %d", ErrClockSkew, e.Time)
 		}
 
-		if err := addToDB(out, username, command, ip, now); err != nil {
-			return fmt.Errorf("error adding to database: %w", err)
-		}
+		flags = append(slices.Clip(flags), flagSkew)
+	}
 
-		count++
+	if src.VerifiedUser != "" && src.VerifiedUser != p.Username {
+		flags = append(slices.Clip(flags), flagUserMismatch)
 
-		if count%1000 == 0 {
-			fmt.Printf("\r%d", count)
+		if src.PID != 0 {
+			slog.Warn("claimed username differs from that of the sending process",
+				"username", p.Username, "verified", src.VerifiedUser, "pid", src.PID)
 		}
 	}
 
-	fmt.Printf("\r%d\n", count)
+	for _, flag := range flags {
+		i.metrics.flagged.WithLabelValues(flag).Inc()
+	}
+
+	e.Flags = strings.Join(flags, ",")
+	e.Category, e.Module = i.rules.Classify(p.Command)
 
-	if err := out.SaveTo(path); err != nil {
-		return fmt.Errorf("error saving database: %w", err)
+	if err := i.queue.Add(e); err != nil {
+		i.metrics.reject("stopping")
+
+		return err
 	}
 
 	return nil
 }
+
+func (i *ingester) isSkewed(t, received int64) bool {
+	if i.config.MaxSkew > 0 && t > received+int64(i.config.MaxSkew/time.Second) {
+		return true
+	}
+
+	return i.config.MaxAge > 0 && t < received-int64(i.config.MaxAge/time.Second)
+}
+
+// Close flushes any queued events to the database.
+func (i *ingester) Close() {
+	i.queue.Close()
+	i.access.Close()
+}
@@ -33,6 +33,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
 )
 
 func TestNewAnalyticsServer(t *testing.T) {
@@ -46,7 +48,15 @@ func TestNewAnalyticsServer(t *testing.T) {
 		t.Fatalf("unexpected error creating database: %s", err)
 	}
 
-	go newAnalyticsServer(l, db)
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{MaxSkew: time.Minute})
+	in.now = func() time.Time { return time.Unix(1700000200, 0) }
+
+	go newAnalyticsServer(l, in)
 
 	c, err := net.Dial("tcp", l.Addr().String())
 	if err != nil {
@@ -72,4 +82,154 @@ func TestNewAnalyticsServer(t *testing.T) {
 	if out := dumpTable(t, db, "events"); !strings.HasPrefix(out, expectedPrefix) {
 		t.Errorf("expecting output to begin with %q, got %q", expectedPrefix, out)
 	}
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error opening connection: %s", err)
+	}
+
+	_, err = io.WriteString(c, "SPA1\x00user=USER\x00command=/path/to/other/command\x00host=node1\x00cwd=/home/user\x00jobid=123\x00version=1.2")
+	if err != nil {
+		t.Fatalf("unexpected error writing to connection: %s", err)
+	}
+
+	c.Close()
+
+	time.Sleep(250 * time.Millisecond)
+
+	expectedSuffix := ",1700000200,ignore,,node1,/home/user,123,1.2,1700000200,,<nil>,<nil>\n"
+
+	if out := dumpTable(t, db, "events"); !strings.HasSuffix(out, expectedSuffix) {
+		t.Errorf("expecting output to end with %q, got %q", expectedSuffix, out)
+	}
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error opening connection: %s", err)
+	}
+
+	_, err = io.WriteString(c, "SPA1\x00user=USER_A\x00command=/path/a\x00time=1700000000\n\x1e"+
+		"SPA1\x00user=USER_B\x00bad\x1e"+
+		"SPA1\x00user=USER_C\x00command=/path/c\x00time=1700000100\x1e"+
+		"SPA1\x00user=USER_D\x00command=/path/d\x00time=1700001000\x1e\n")
+	if err != nil {
+		t.Fatalf("unexpected error writing to connection: %s", err)
+	}
+
+	c.Close()
+
+	time.Sleep(250 * time.Millisecond)
+
+	ip := c.LocalAddr().(*net.TCPAddr).IP.String()
+	expectedSuffix = "USER_A,/path/a," + ip + ",1700000000,ignore,,,,,,1700000200,,<nil>,<nil>\n" +
+		"USER_C,/path/c," + ip + ",1700000100,ignore,,,,,,1700000200,,<nil>,<nil>\n" +
+		"USER_D,/path/d," + ip + ",1700001000,ignore,,,,,,1700000200,skew,<nil>,<nil>\n"
+
+	if out := dumpTable(t, db, "events"); !strings.HasSuffix(out, expectedSuffix) {
+		t.Errorf("expecting output to end with %q, got %q", expectedSuffix, out)
+	}
+}
+
+func TestNewUDPServer(t *testing.T) {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	defer uc.Close()
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	go newUDPServer(uc, newIngester(db, rules, newMetrics(db), ingestConfig{}))
+
+	c, err := net.Dial("udp", uc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unexpected error opening connection: %s", err)
+	}
+
+	for _, payload := range [...]string{
+		"USER\x00/path/to/some/command",
+		"malformed",
+		"SPA1\x00user=USER2\x00command=/path/to/other/command\x00host=node1",
+	} {
+		if _, err = io.WriteString(c, payload); err != nil {
+			t.Fatalf("unexpected error writing to connection: %s", err)
+		}
+	}
+
+	c.Close()
+
+	time.Sleep(250 * time.Millisecond)
+
+	ip := c.LocalAddr().(*net.UDPAddr).IP.String()
+	out := dumpTable(t, db, "events")
+
+	for _, expectedPrefix := range [...]string{
+		"USER,/path/to/some/command," + ip + ",",
+		"USER2,/path/to/other/command," + ip + ",",
+	} {
+		if !strings.HasPrefix(out, expectedPrefix) {
+			t.Errorf("expecting output line to begin with %q, got %q", expectedPrefix, out)
+		}
+
+		_, out, _ = strings.Cut(out, "\n")
+	}
+
+	if out != "" {
+		t.Errorf("expecting only two events, got extra %q", out)
+	}
+}
+
+func TestAnalyticsClient(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{
+		Auth: authenticator{mode: authRequire, keys: map[string][]byte{"key": []byte("secret")}},
+	})
+	in.now = func() time.Time { return time.Unix(1700000200, 0) }
+
+	go newAnalyticsServer(l, in)
+
+	c := analytics.NewClient(analytics.Config{Addr: l.Addr().String(), KeyID: "key", Secret: []byte("secret")})
+
+	if err := c.SendSync(analytics.Payload{
+		Username: "USER",
+		Command:  "/path/to/command",
+		Hostname: "node1",
+		Time:     1700000100,
+	}); err != nil {
+		t.Fatalf("unexpected error sending event: %s", err)
+	}
+
+	c.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	in.Close()
+
+	expected := "USER,/path/to/command,127.0.0.1,1700000100,ignore,,node1,,,,1700000200,,<nil>,<nil>\n"
+
+	if out := dumpTable(t, db, "events"); out != expected {
+		t.Errorf("expecting events table to be %q, got %q", expected, out)
+	}
 }
@@ -0,0 +1,227 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "softpack_analytics"
+
+// metrics contains the Prometheus metrics for the ingest server.
+type metrics struct {
+	registry *prometheus.Registry
+
+	connections    prometheus.Counter
+	activeConns    prometheus.Gauge
+	datagrams      prometheus.Counter
+	parsed         prometheus.Counter
+	rejected       *prometheus.CounterVec
+	flagged        *prometheus.CounterVec
+	dropped        *prometheus.CounterVec
+	dbErrors       prometheus.Counter
+	handleDuration prometheus.Histogram
+	writeDuration  prometheus.Histogram
+	batchSize      prometheus.Histogram
+	queueBlocked   prometheus.Counter
+	forwarded      prometheus.Counter
+	forwardErrors  prometheus.Counter
+}
+
+// newMetrics creates the metrics, including those of the modules in the given
+// database, unless it is nil.
+func newMetrics(db *DB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_total",
+			Help:      "Number of ingest connections accepted.",
+		}),
+		activeConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_active",
+			Help:      "Number of ingest connections being handled.",
+		}),
+		datagrams: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "datagrams_total",
+			Help:      "Number of UDP datagrams received.",
+		}),
+		parsed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "payloads_parsed_total",
+			Help:      "Number of payloads successfully parsed.",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "payloads_rejected_total",
+			Help:      "Number of payloads rejected, by reason.",
+		}, []string{"reason"}),
+		flagged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_flagged_total",
+			Help:      "Number of events accepted with a flag, by flag.",
+		}, []string{"flag"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_dropped_total",
+			Help:      "Number of connections, datagrams and requests dropped because of their source, by reason.",
+		}, []string{"reason"}),
+		dbErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_write_errors_total",
+			Help:      "Number of events that could not be written to the database.",
+		}),
+		handleDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "connection_duration_seconds",
+			Help:      "Time taken to read and record the payload of an ingest connection.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		writeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_write_duration_seconds",
+			Help:      "Time taken to write a batch of events to the database.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_write_batch_size",
+			Help:      "Number of events written to the database in each batch.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		queueBlocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_full_total",
+			Help:      "Number of events that had to wait because the write queue was full.",
+		}),
+		forwarded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_forwarded_total",
+			Help:      "Number of events forwarded to the upstream server by a relay.",
+		}),
+		forwardErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "forward_errors_total",
+			Help:      "Number of failed attempts to forward a batch of events to the upstream server.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.connections, m.activeConns, m.datagrams, m.parsed, m.rejected, m.flagged, m.dropped, m.dbErrors, m.handleDuration, m.writeDuration, m.batchSize, m.queueBlocked,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if db != nil {
+		m.registry.MustRegister(newModuleCollector(db))
+	}
+
+	return m
+}
+
+func (m *metrics) registerQueue(q *writeQueue) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_length",
+			Help:      "Number of events waiting to be written to the database.",
+		}, func() float64 { return float64(q.Len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_capacity",
+			Help:      "Maximum number of events that can wait to be written to the database.",
+		}, func() float64 { return float64(q.config.Size) }),
+	)
+}
+
+func (m *metrics) registerSpool(s *spool) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "spool_batches",
+			Help:      "Number of batches of events in the relay spool waiting to be forwarded.",
+		}, func() float64 { return float64(s.Len()) }),
+		m.forwarded, m.forwardErrors,
+	)
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) reject(reason string) {
+	m.rejected.WithLabelValues(reason).Inc()
+}
+
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// moduleCollector reports the number of distinct users and modules in each
+// category, as read from the database at scrape time.
+type moduleCollector struct {
+	db      *DB
+	users   *prometheus.Desc
+	modules *prometheus.Desc
+}
+
+func newModuleCollector(db *DB) *moduleCollector {
+	return &moduleCollector{
+		db: db,
+		users: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "module_users"),
+			"Number of distinct users of modules in a category.", []string{"category"}, nil),
+		modules: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "modules"),
+			"Number of distinct modules used in a category.", []string{"category"}, nil),
+	}
+}
+
+func (c *moduleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.users
+	ch <- c.modules
+}
+
+func (c *moduleCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, category := range c.db.Categories() {
+		users, modules, err := c.db.CategoryStats(category)
+		if err != nil {
+			slog.Error("error reading category statistics", "category", category, "err", err)
+
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.users, prometheus.GaugeValue, float64(users), category)
+		ch <- prometheus.MustNewConstMetric(c.modules, prometheus.GaugeValue, float64(modules), category)
+	}
+}
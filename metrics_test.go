@@ -0,0 +1,100 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	db, err := NewDB(":memory:", "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := ParseRules(strings.NewReader("rules:\n  - prefix: /opt/\n    category: other\n"))
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	m := newMetrics(db)
+
+	go newAnalyticsServer(l, newIngester(db, rules, m, ingestConfig{}))
+
+	for _, payload := range [...]string{
+		"userA\x00/opt/moduleA",
+		"userB\x00/opt/moduleA",
+		"userB\x00/opt/moduleB",
+		"no separator",
+		"too\x00many\x00separators",
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error opening connection: %s", err)
+		}
+
+		if _, err = io.WriteString(c, payload); err != nil {
+			t.Fatalf("unexpected error writing to connection: %s", err)
+		}
+
+		c.Close()
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+
+	m.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := w.Body.String()
+
+	for _, expected := range [...]string{
+		"softpack_analytics_connections_total 5\n",
+		"softpack_analytics_payloads_parsed_total 3\n",
+		"softpack_analytics_payloads_rejected_total{reason=\"malformed\"} 2\n",
+		"softpack_analytics_db_write_errors_total 0\n",
+		"softpack_analytics_db_write_batch_size_sum 3\n",
+		"softpack_analytics_queue_length 0\n",
+		"softpack_analytics_connection_duration_seconds_count 5\n",
+		"softpack_analytics_module_users{category=\"other\"} 2\n",
+		"softpack_analytics_modules{category=\"other\"} 2\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expecting metrics to contain %q", expected)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLen = 107
+
+	proxyV2HeaderLen = 16
+	proxyV2Version   = 0x20
+	proxyV2CmdLocal  = 0x00
+	proxyV2CmdProxy  = 0x01
+	proxyV2TCP4      = 0x11
+	proxyV2TCP6      = 0x21
+	proxyV2Addr4Len  = 12
+	proxyV2Addr6Len  = 36
+)
+
+var (
+	ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyListener wraps a listener so that connections from trusted proxies have
+// their addresses taken from the PROXY protocol header that they begin with.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// withProxyProtocol wraps the listener so that connections from the given
+// trusted proxies must begin with a PROXY protocol (v1 or v2) header, giving the
+// address of the original client. The header must be received within the
+// timeout, unless it is zero.
+func withProxyProtocol(l net.Listener, trusted []*net.IPNet, timeout time.Duration) net.Listener {
+	if len(trusted) == 0 {
+		return l
+	}
+
+	return &proxyListener{Listener: l, trusted: trusted, timeout: timeout}
+}
+
+func (p *proxyListener) Accept() (net.Conn, error) {
+	c, err := p.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(addrIP(c.RemoteAddr()))
+	if ip == nil || !containsIP(p.trusted, ip) {
+		return c, nil
+	}
+
+	return &proxyConn{Conn: c, r: bufio.NewReaderSize(c, proxyV1MaxLen), timeout: p.timeout}, nil
+}
+
+// proxyConn is a connection from a trusted proxy. The header is read on the
+// first call to Read, RemoteAddr or LocalAddr, so that a slow proxy does not
+// hold up the accepting of other connections.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once          sync.Once
+	local, remote net.Addr
+	err           error
+}
+
+func (p *proxyConn) readHeader() {
+	if p.timeout > 0 {
+		p.Conn.SetReadDeadline(time.Now().Add(p.timeout)) //nolint:errcheck
+		defer p.Conn.SetReadDeadline(time.Time{})         //nolint:errcheck
+	}
+
+	p.local, p.remote, p.err = readProxyHeader(p.r)
+	if p.err != nil {
+		p.err = fmt.Errorf("%w: %w", ErrProxyHeader, p.err)
+	}
+}
+
+// headerErr returns the error, if any, from reading the PROXY protocol header.
+func (p *proxyConn) headerErr() error {
+	p.once.Do(p.readHeader)
+
+	return p.err
+}
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	if err := p.headerErr(); err != nil {
+		return 0, err
+	}
+
+	return p.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client that connected to the proxy, or
+// of the proxy itself if the header did not give one.
+func (p *proxyConn) RemoteAddr() net.Addr {
+	if p.headerErr() != nil || p.remote == nil {
+		return p.Conn.RemoteAddr()
+	}
+
+	return p.remote
+}
+
+// LocalAddr returns the address that the client connected to on the proxy, or
+// the local address if the header did not give one.
+func (p *proxyConn) LocalAddr() net.Addr {
+	if p.headerErr() != nil || p.local == nil {
+		return p.Conn.LocalAddr()
+	}
+
+	return p.local
+}
+
+// proxyHeaderErr returns the error, if any, from reading the PROXY protocol
+// header of a connection from a trusted proxy.
+func proxyHeaderErr(c net.Conn) error {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+
+	if pc, ok := c.(*proxyConn); ok {
+		return pc.headerErr()
+	}
+
+	return nil
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header, returning the
+// destination and source addresses it contains. Both are nil for headers that
+// do not give addresses, such as health checks from the proxy.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, nil, err
+	} else if !bytes.HasPrefix(line, []byte(proxyV1Prefix)) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("unexpected header %q", line)
+	}
+
+	fields := strings.Fields(string(line[len(proxyV1Prefix):]))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	} else if len(fields) != 5 || fields[0] != "TCP4" && fields[0] != "TCP6" {
+		return nil, nil, fmt.Errorf("unexpected header %q", line)
+	}
+
+	src, err := parseProxyV1Addr(fields[1], fields[3])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dst, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dst, src, nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid address %q", ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	addr.Port = int(p)
+
+	return addr, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var header [proxyV2HeaderLen]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+
+	if verCmd&0xF0 != proxyV2Version {
+		return nil, nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch verCmd & 0x0F {
+	case proxyV2CmdLocal:
+		return nil, nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", verCmd&0x0F)
+	}
+
+	switch family {
+	case proxyV2TCP4:
+		return parseProxyV2Addrs(body, net.IPv4len, proxyV2Addr4Len)
+	case proxyV2TCP6:
+		return parseProxyV2Addrs(body, net.IPv6len, proxyV2Addr6Len)
+	}
+
+	return nil, nil, nil
+}
+
+func parseProxyV2Addrs(body []byte, ipLen, addrLen int) (net.Addr, net.Addr, error) {
+	if len(body) < addrLen {
+		return nil, nil, fmt.Errorf("address block too short: %d bytes", len(body))
+	}
+
+	ports := body[2*ipLen:]
+
+	src := &net.TCPAddr{IP: net.IP(slices.Clone(body[:ipLen])), Port: int(binary.BigEndian.Uint16(ports))}
+	dst := &net.TCPAddr{IP: net.IP(slices.Clone(body[ipLen : 2*ipLen])), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+
+	return dst, src, nil
+}
@@ -0,0 +1,159 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, family byte, body ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, verCmd, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+
+		return string(append(header, body...))
+	}
+
+	for n, test := range [...]struct {
+		Header, Local, Remote string
+		Error                 bool
+	}{
+		{Header: "PROXY TCP4 10.1.2.3 192.168.0.1 5678 1234\r\n", Local: "192.168.0.1:1234", Remote: "10.1.2.3:5678"},
+		{Header: "PROXY TCP6 2001:db8::1 2001:db8::2 5678 1234\r\n", Local: "[2001:db8::2]:1234", Remote: "[2001:db8::1]:5678"},
+		{Header: "PROXY UNKNOWN\r\n"},
+		{Header: "PROXY TCP4 10.1.2.3 192.168.0.1 5678\r\n", Error: true},
+		{Header: "PROXY TCP4 10.1.2.3 192.168.0.1 99999 1234\r\n", Error: true},
+		{Header: "PROXY TCP4 10.1.2.3 192.168.0.1 5678 1234\n", Error: true},
+		{Header: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", Error: true},
+		{Header: "USER\x00/path/to/command", Error: true},
+		{
+			Header: v2(0x21, proxyV2TCP4, 10, 1, 2, 3, 192, 168, 0, 1, 0x16, 0x2e, 0x04, 0xd2, 0, 0),
+			Local:  "192.168.0.1:1234",
+			Remote: "10.1.2.3:5678",
+		},
+		{Header: v2(0x20, proxyV2TCP4, 10, 1, 2, 3, 192, 168, 0, 1, 0x16, 0x2e, 0x04, 0xd2)},
+		{Header: v2(0x21, 0x31, 0, 0)},
+		{Header: v2(0x21, proxyV2TCP4, 10, 1, 2, 3), Error: true},
+		{Header: v2(0x11, proxyV2TCP4, 10, 1, 2, 3, 192, 168, 0, 1, 0x16, 0x2e, 0x04, 0xd2), Error: true},
+	} {
+		r := bufio.NewReaderSize(strings.NewReader(test.Header+"DATA"), proxyV1MaxLen)
+
+		local, remote, err := readProxyHeader(r)
+		if test.Error {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+
+			continue
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if addrString(local) != test.Local || addrString(remote) != test.Remote {
+			t.Errorf("test %d: expecting addresses %q and %q, got %q and %q",
+				n+1, test.Local, test.Remote, addrString(local), addrString(remote))
+		}
+
+		if rest, _ := io.ReadAll(r); string(rest) != "DATA" { //nolint:errcheck
+			t.Errorf("test %d: expecting data after header, got %q", n+1, rest)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
+func TestProxyListener(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{})
+
+	for _, trusted := range [...]string{"127.0.0.1", "10.0.0.0/8"} {
+		proxies, err := parseCIDRs(trusted)
+		if err != nil {
+			t.Fatalf("unexpected error parsing CIDRs: %s", err)
+		}
+
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("unexpected error creating listener: %s", err)
+		}
+
+		defer l.Close()
+
+		go newAnalyticsServer(withProxyProtocol(l, proxies, time.Second), in) //nolint:errcheck
+
+		for _, payload := range [...]string{
+			"PROXY TCP4 10.1.2.3 192.168.0.1 5678 1234\r\nUSER_" + trusted + "\x00/path/to/command",
+			"USER_NOHEADER_" + trusted + "\x00/path/to/command",
+		} {
+			c := dialTest(t, l)
+
+			io.WriteString(c, payload) //nolint:errcheck
+			c.Close()
+		}
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	out := dumpTable(t, db, "events")
+
+	for _, expected := range [...]string{
+		"USER_127.0.0.1,/path/to/command,10.1.2.3,",
+		"USER_NOHEADER_10.0.0.0/8,/path/to/command,127.0.0.1,",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expecting events table to contain %q, got %q", expected, out)
+		}
+	}
+
+	if strings.Count(out, ",10.1.2.3,") != 1 || strings.Contains(out, "USER_NOHEADER_127.0.0.1") {
+		t.Errorf("expecting only the trusted proxy header to be used, got %q", out)
+	}
+}
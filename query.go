@@ -0,0 +1,357 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// QueryOptions contains the time range and pagination used by the query
+// methods. A zero From or To leaves that end of the time range unbounded, and a
+// time range causes results to be calculated from the events table, instead of
+// the module tables.
+//
+// When Received is set, the time the server received each event is used instead
+// of the time sent by the client, which also causes results to be calculated
+// from the events table. Events without a received time use their event time.
+type QueryOptions struct {
+	From, To      int64
+	Limit, Offset int
+	Received      bool
+}
+
+func (q QueryOptions) hasRange() bool {
+	return q.From != 0 || q.To != 0
+}
+
+func (q QueryOptions) fromEvents() bool {
+	return q.hasRange() || q.Received
+}
+
+func (q QueryOptions) timeColumn() string {
+	if q.Received {
+		return "COALESCE(received, time)"
+	}
+
+	return "time"
+}
+
+func (q QueryOptions) limit() int {
+	if q.Limit <= 0 {
+		return -1
+	}
+
+	return q.Limit
+}
+
+func (q QueryOptions) timeRange() (int64, int64) {
+	if q.To == 0 {
+		return q.From, math.MaxInt64
+	}
+
+	return q.From, q.To
+}
+
+// ModuleUsage is the usage of a single module, either by all users or by a
+// single user.
+type ModuleUsage struct {
+	Category string `json:"category,omitempty"`
+	Module   string `json:"module"`
+	Users    int64  `json:"users,omitempty"`
+	Count    int64  `json:"count"`
+	FirstUse int64  `json:"firstuse"`
+	LastUse  int64  `json:"lastuse"`
+}
+
+// UserUsage is the usage of a single module by a single user.
+type UserUsage struct {
+	Username string `json:"username"`
+	Count    int64  `json:"count"`
+	FirstUse int64  `json:"firstuse"`
+	LastUse  int64  `json:"lastuse"`
+}
+
+// EventFilter restricts the events counted by EventCounts. Empty fields match
+// all events.
+type EventFilter struct {
+	Username string
+	Category string
+	Module   string
+}
+
+// EventCount is the number of events in the interval starting at Time.
+type EventCount struct {
+	Time  int64 `json:"time"`
+	Count int64 `json:"count"`
+}
+
+type conditions struct {
+	clauses []string
+	args    []any
+}
+
+func (c *conditions) add(clause string, args ...any) {
+	c.clauses = append(c.clauses, clause)
+	c.args = append(c.args, args...)
+}
+
+func (c *conditions) addRange(q QueryOptions) {
+	if q.hasRange() {
+		from, to := q.timeRange()
+
+		c.add(q.timeColumn()+" >= ? AND "+q.timeColumn()+" < ?", from, to)
+	}
+}
+
+func minMax(q QueryOptions) string {
+	return "MIN(" + q.timeColumn() + "), MAX(" + q.timeColumn() + ")"
+}
+
+func (c *conditions) String() string {
+	if len(c.clauses) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(c.clauses, " AND ")
+}
+
+func (d *DB) checkCategory(category string) error {
+	if _, ok := d.categories[category]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownCategory, category)
+	}
+
+	return nil
+}
+
+// TopModules returns the modules of the given category, ordered by the number of
+// times they have been used.
+func (d *DB) TopModules(category string, q QueryOptions) ([]ModuleUsage, error) {
+	if err := d.checkCategory(category); err != nil {
+		return nil, err
+	}
+
+	var (
+		query string
+		where conditions
+	)
+
+	if q.fromEvents() {
+		where.add("category = ? AND module != ''", category)
+		where.addRange(q)
+
+		query = "SELECT module, COUNT(DISTINCT username), COUNT(*), " + minMax(q) + " FROM [events]"
+	} else {
+		query = "SELECT module, COUNT(username), SUM(count), MIN(firstuse), MAX(lastuse) FROM " + moduleTable(category)
+	}
+
+	query += where.String() + " GROUP BY module ORDER BY 3 DESC, module LIMIT ? OFFSET ?;"
+
+	return queryRows(d.reader, query, append(where.args, q.limit(), q.Offset), func(rows *sql.Rows) (ModuleUsage, error) {
+		var m ModuleUsage
+
+		err := rows.Scan(&m.Module, &m.Users, &m.Count, &m.FirstUse, &m.LastUse)
+
+		return m, err
+	})
+}
+
+// ModuleUsers returns the users of the given module, ordered by the number of
+// times they have used it.
+func (d *DB) ModuleUsers(category, module string, q QueryOptions) ([]UserUsage, error) {
+	if err := d.checkCategory(category); err != nil {
+		return nil, err
+	}
+
+	var (
+		query string
+		where conditions
+	)
+
+	if q.fromEvents() {
+		where.add("category = ? AND module = ?", category, module)
+		where.addRange(q)
+
+		query = "SELECT username, COUNT(*), " + minMax(q) + " FROM [events]" + where.String() + " GROUP BY username"
+	} else {
+		where.add("module = ?", module)
+
+		query = "SELECT username, count, firstuse, lastuse FROM " + moduleTable(category) + where.String()
+	}
+
+	query += " ORDER BY 2 DESC, username LIMIT ? OFFSET ?;"
+
+	return queryRows(d.reader, query, append(where.args, q.limit(), q.Offset), func(rows *sql.Rows) (UserUsage, error) {
+		var u UserUsage
+
+		err := rows.Scan(&u.Username, &u.Count, &u.FirstUse, &u.LastUse)
+
+		return u, err
+	})
+}
+
+// UserModules returns the modules used by the given user, optionally restricted
+// to a single category, ordered by the number of times they have been used.
+func (d *DB) UserModules(username, category string, q QueryOptions) ([]ModuleUsage, error) {
+	categories := d.Categories()
+
+	if category != "" {
+		if err := d.checkCategory(category); err != nil {
+			return nil, err
+		}
+
+		categories = []string{category}
+	}
+
+	var (
+		query string
+		args  []any
+	)
+
+	if q.fromEvents() {
+		var where conditions
+
+		where.add("username = ? AND module != ''", username)
+
+		if category != "" {
+			where.add("category = ?", category)
+		}
+
+		where.addRange(q)
+
+		query = "SELECT category, module, COUNT(*), " + minMax(q) + " FROM [events]" +
+			where.String() + " GROUP BY category, module"
+		args = where.args
+	} else {
+		selects := make([]string, len(categories))
+
+		for n, c := range categories {
+			selects[n] = "SELECT ? AS category, module, count, firstuse, lastuse FROM " + moduleTable(c) + " WHERE username = ?"
+			args = append(args, c, username)
+		}
+
+		query = strings.Join(selects, " UNION ALL ")
+	}
+
+	if query == "" {
+		return []ModuleUsage{}, nil
+	}
+
+	query += " ORDER BY 3 DESC, 1, 2 LIMIT ? OFFSET ?;"
+
+	return queryRows(d.reader, query, append(args, q.limit(), q.Offset), func(rows *sql.Rows) (ModuleUsage, error) {
+		var m ModuleUsage
+
+		err := rows.Scan(&m.Category, &m.Module, &m.Count, &m.FirstUse, &m.LastUse)
+
+		return m, err
+	})
+}
+
+// EventCounts returns the number of events matching the filter in the time
+// range of the query options. When interval is positive, the counts are grouped
+// into buckets of that many seconds, otherwise a single total is returned.
+func (d *DB) EventCounts(filter EventFilter, interval int64, q QueryOptions) ([]EventCount, error) {
+	var where conditions
+
+	for _, field := range [...]struct{ column, value string }{
+		{"username", filter.Username},
+		{"category", filter.Category},
+		{"module", filter.Module},
+	} {
+		if field.value != "" {
+			where.add(field.column+" = ?", field.value)
+		}
+	}
+
+	where.addRange(q)
+
+	var (
+		query string
+		args  []any
+	)
+
+	if interval > 0 {
+		column := q.timeColumn()
+
+		query = "SELECT " + column + " - (" + column + " % ?) AS bucket, COUNT(*) FROM [events]" + where.String() +
+			" GROUP BY bucket ORDER BY bucket LIMIT ? OFFSET ?;"
+		args = append(append([]any{interval}, where.args...), q.limit(), q.Offset)
+	} else {
+		query = "SELECT ?, COUNT(*) FROM [events]" + where.String() + ";"
+		args = append([]any{q.From}, where.args...)
+	}
+
+	return queryRows(d.reader, query, args, func(rows *sql.Rows) (EventCount, error) {
+		var e EventCount
+
+		err := rows.Scan(&e.Time, &e.Count)
+
+		return e, err
+	})
+}
+
+// CategoryStats returns the number of distinct users and modules in the module
+// table of the given category.
+func (d *DB) CategoryStats(category string) (int64, int64, error) {
+	if err := d.checkCategory(category); err != nil {
+		return 0, 0, err
+	}
+
+	var users, modules int64
+
+	if err := d.reader.QueryRow("SELECT COUNT(DISTINCT username), COUNT(DISTINCT module) FROM "+
+		moduleTable(category)+";").Scan(&users, &modules); err != nil {
+		return 0, 0, fmt.Errorf("error reading statistics for category %q: %w", category, err)
+	}
+
+	return users, modules, nil
+}
+
+func queryRows[T any](db *sql.DB, query string, args []any, scan func(*sql.Rows) (T, error)) ([]T, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error running query %q: %w", query, err)
+	}
+
+	defer rows.Close()
+
+	results := []T{}
+
+	for rows.Next() {
+		result, err := scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,245 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueSize     = 10000
+	defaultBatchSize     = 500
+	defaultBatchInterval = 100 * time.Millisecond
+
+	minRetryBackoff = 10 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// queueConfig configures the write queue. Zero values are replaced by the
+// defaults.
+type queueConfig struct {
+	Size      int
+	BatchSize int
+	Interval  time.Duration
+}
+
+func (c queueConfig) withDefaults() queueConfig {
+	if c.Size <= 0 {
+		c.Size = defaultQueueSize
+	}
+
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = defaultBatchInterval
+	}
+
+	return c
+}
+
+var ErrQueueClosed = errors.New("server stopping")
+
+// eventWriter stores batches of events; it is implemented by DB and, for
+// relays, by spool.
+type eventWriter interface {
+	AddEvents(events []Event) error
+}
+
+// writeQueue is a bounded queue of events, written to the database in batches
+// by a single writer.
+type writeQueue struct {
+	db      eventWriter
+	metrics *metrics
+	config  queueConfig
+	events  chan Event
+	done    chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	closing chan struct{}
+	adding  sync.WaitGroup
+}
+
+func newWriteQueue(db eventWriter, m *metrics, config queueConfig) *writeQueue {
+	config = config.withDefaults()
+
+	q := &writeQueue{
+		db:      db,
+		metrics: m,
+		config:  config,
+		events:  make(chan Event, config.Size),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+
+	m.registerQueue(q)
+
+	go q.run()
+
+	return q
+}
+
+// Add queues an event to be written, blocking while the queue is full. Returns
+// ErrQueueClosed if the queue is closed before the event could be queued.
+func (q *writeQueue) Add(e Event) error {
+	q.mu.Lock()
+
+	if q.closed {
+		q.mu.Unlock()
+
+		return ErrQueueClosed
+	}
+
+	q.adding.Add(1)
+	q.mu.Unlock()
+
+	defer q.adding.Done()
+
+	select {
+	case q.events <- e:
+		return nil
+	default:
+		q.metrics.queueBlocked.Inc()
+	}
+
+	select {
+	case q.events <- e:
+		return nil
+	case <-q.closing:
+		return ErrQueueClosed
+	}
+}
+
+// Len returns the number of events waiting in the queue.
+func (q *writeQueue) Len() int {
+	return len(q.events)
+}
+
+// Close stops the queue, returning once all queued events have been written.
+// Calls to Add that are waiting for space, or made after Close, are rejected.
+func (q *writeQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	close(q.closing)
+	q.mu.Unlock()
+
+	q.adding.Wait()
+	close(q.events)
+	<-q.done
+}
+
+func (q *writeQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.config.Interval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, q.config.BatchSize)
+
+	for {
+		select {
+		case e, ok := <-q.events:
+			if !ok {
+				q.flush(batch)
+
+				return
+			}
+
+			batch = append(batch, e)
+
+			if len(batch) >= q.config.BatchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes the batch in a single transaction. Should that fail because of
+// an event in it, each event is retried on its own, so that one bad event
+// cannot lose the entire batch.
+func (q *writeQueue) flush(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	start := time.Now()
+	err := q.write(batch)
+
+	q.metrics.writeDuration.Observe(since(start))
+	q.metrics.batchSize.Observe(float64(len(batch)))
+
+	if err == nil {
+		return
+	} else if !isEventError(err) {
+		q.metrics.dbErrors.Inc()
+		slog.Error("error writing to database", "err", err, "dropped", len(batch))
+
+		return
+	}
+
+	for _, e := range batch {
+		if err := q.write([]Event{e}); err != nil {
+			q.metrics.dbErrors.Inc()
+			slog.Error("error writing to database", "err", err)
+		}
+	}
+}
+
+// write writes the events, retrying with an exponential backoff for as long as
+// the database is busy or locked, e.g. by a reclassify, so that no events are
+// lost; meanwhile, the queue fills and connections wait for space in it.
+func (q *writeQueue) write(events []Event) error {
+	backoff := minRetryBackoff
+
+	for retries := 0; ; retries++ {
+		err := q.db.AddEvents(events)
+		if !isBusy(err) {
+			if retries > 0 {
+				slog.Info("database no longer busy", "retries", retries)
+			}
+
+			return err
+		}
+
+		if retries == 0 {
+			slog.Warn("database busy, retrying until it is not", "err", err)
+		}
+
+		time.Sleep(backoff)
+
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
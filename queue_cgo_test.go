@@ -0,0 +1,101 @@
+//go:build cgo
+
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// flakyWriter fails each write with the given errors, in turn, before recording
+// the batches written.
+type flakyWriter struct {
+	mu      sync.Mutex
+	errs    []error
+	batches [][]Event
+}
+
+func (f *flakyWriter) AddEvents(events []Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+
+		return err
+	}
+
+	f.batches = append(f.batches, events)
+
+	return nil
+}
+
+func TestWriteQueueRetry(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	constraint := sqlite3.Error{Code: sqlite3.ErrConstraint}
+
+	for n, test := range [...]struct {
+		Errs    []error
+		Batches int
+	}{
+		{Errs: nil, Batches: 1},
+		{Errs: []error{busy, busy, sqlite3.Error{Code: sqlite3.ErrLocked}}, Batches: 1},
+		{Errs: []error{constraint}, Batches: 3},
+		{Errs: []error{busy, constraint, busy}, Batches: 3},
+		{Errs: []error{errors.New("disk full")}, Batches: 0},
+	} {
+		w := &flakyWriter{errs: test.Errs}
+		q := newWriteQueue(w, newMetrics(nil), queueConfig{BatchSize: 3, Interval: time.Hour})
+
+		for e := 0; e < 3; e++ {
+			q.Add(Event{Username: "userA", Command: "cmd", Time: int64(e)}) //nolint:errcheck
+		}
+
+		q.Close()
+
+		if len(w.batches) != test.Batches {
+			t.Errorf("test %d: expecting %d batches to be written, got %d", n+1, test.Batches, len(w.batches))
+		}
+
+		written := 0
+
+		for _, batch := range w.batches {
+			written += len(batch)
+		}
+
+		if expected := min(test.Batches, 1) * 3; written != expected {
+			t.Errorf("test %d: expecting %d events to be written, got %d", n+1, expected, written)
+		}
+	}
+}
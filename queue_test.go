@@ -0,0 +1,121 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+	db, err := NewDB(":memory:", "other")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	m := newMetrics(db)
+	q := newWriteQueue(db, m, queueConfig{BatchSize: 2, Interval: time.Hour})
+
+	q.Add(Event{Username: "userA", Command: "cmd1", IP: "127.0.0.1", Time: 1, Category: "other", Module: "moduleA"}) //nolint:errcheck
+
+	time.Sleep(50 * time.Millisecond)
+
+	if table := dumpTable(t, db, "events"); table != "" {
+		t.Errorf("expecting no events to be written before batch is full, got:\n%s", table)
+	}
+
+	q.Add(Event{Username: "userA", Command: "cmd2", IP: "127.0.0.1", Time: 2, Category: "unknown", Module: "moduleB"}) //nolint:errcheck
+
+	time.Sleep(50 * time.Millisecond)
+
+	const expected = "userA,cmd1,127.0.0.1,1,other,moduleA,,,,,<nil>,,<nil>,<nil>\n"
+
+	if table := dumpTable(t, db, "events"); table != expected {
+		t.Errorf("expecting events table to be:\n%s\ngot:\n%s", expected, table)
+	}
+
+	q.Add(Event{Username: "userB", Command: "cmd3", IP: "127.0.0.1", Time: 3, Category: "other", Module: "moduleA"}) //nolint:errcheck
+	q.Close()
+
+	const expectedModules = "moduleA,userA,1,1,1\nmoduleA,userB,1,3,3\n"
+
+	if table := dumpTable(t, db, "othermodules"); table != expectedModules {
+		t.Errorf("expecting events to be flushed on close, got:\n%s", table)
+	}
+}
+
+// blockingWriter blocks each write until released.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (b blockingWriter) AddEvents([]Event) error {
+	<-b.release
+
+	return nil
+}
+
+func TestWriteQueueClosed(t *testing.T) {
+	w := blockingWriter{release: make(chan struct{})}
+	q := newWriteQueue(w, newMetrics(nil), queueConfig{Size: 1, BatchSize: 1, Interval: time.Hour})
+
+	q.Add(Event{Username: "userA", Command: "cmd1"}) //nolint:errcheck
+
+	time.Sleep(50 * time.Millisecond)
+
+	q.Add(Event{Username: "userA", Command: "cmd2"}) //nolint:errcheck
+
+	added := make(chan error)
+
+	go func() { added <- q.Add(Event{Username: "userA", Command: "cmd3"}) }()
+
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+
+	select {
+	case err := <-added:
+		if !errors.Is(err, ErrQueueClosed) {
+			t.Errorf("expecting ErrQueueClosed for blocked event, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting blocked event to be rejected when the queue is closed")
+	}
+
+	close(w.release)
+	<-closed
+
+	if err := q.Add(Event{Username: "userA", Command: "cmd4"}); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("expecting ErrQueueClosed after close, got %v", err)
+	}
+}
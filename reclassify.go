@@ -0,0 +1,108 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var ErrNoDatabase = errors.New("no database file given")
+
+func runReclassify(args []string) error {
+	flags := newFlagSet("reclassify", "", "Reclassifies the events in the database with the rules given by -r, updating the module tables.")
+	output := flags.String("d", "", "db file")
+	rulesFile := flags.String("r", "", "classification rules file")
+	from := flags.String("from", "", "only reclassify events at or after this time (YYYY-MM-DD [HH:MM:SS])")
+	to := flags.String("to", "", "only reclassify events before this time (YYYY-MM-DD [HH:MM:SS])")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return ErrNoDatabase
+	}
+
+	rules, err := LoadRules(*rulesFile)
+	if err != nil {
+		return fmt.Errorf("error loading rules: %w", err)
+	}
+
+	start, err := parseTimeFlag(*from)
+	if err != nil {
+		return fmt.Errorf("invalid -from time: %w", err)
+	}
+
+	end, err := parseTimeFlag(*to)
+	if err != nil {
+		return fmt.Errorf("invalid -to time: %w", err)
+	}
+
+	db, err := NewDB(*output, rules.Categories()...)
+	if err != nil {
+		return fmt.Errorf("error opening database (%s): %w", *output, err)
+	}
+
+	defer db.Close()
+
+	slog.Info("Reclassifying…")
+
+	if err := db.Reclassify(rules.Classify, start, end, func(count int) {
+		fmt.Printf("\r%d", count)
+	}); err != nil {
+		return fmt.Errorf("error reclassifying events: %w", err)
+	}
+
+	fmt.Println()
+	slog.Info("…Done")
+
+	return nil
+}
+
+// parseTimeFlag parses a date, or date and time, in the local timezone into a
+// Unix timestamp. An empty string returns zero.
+func parseTimeFlag(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	layout := time.DateTime
+
+	if len(value) == len(time.DateOnly) {
+		layout = time.DateOnly
+	}
+
+	t, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Unix(), nil
+}
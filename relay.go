@@ -0,0 +1,531 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
+)
+
+const (
+	// relayPath is the path of the HTTP endpoint that relays forward events to.
+	relayPath = "/api/relay"
+
+	maxRelayBodySize = 16 << 20
+
+	defaultForwardInterval = time.Second
+	defaultMaxBackoff      = 5 * time.Minute
+	forwardTimeout         = 30 * time.Second
+
+	// batchIDSize is the number of random bytes identifying each spooled batch.
+	batchIDSize = 16
+
+	spoolExt    = ".json"
+	rejectedExt = ".rejected"
+)
+
+var (
+	ErrUpstream         = errors.New("upstream error")
+	ErrUpstreamRejected = errors.New("upstream rejected batch")
+	ErrRelayKey         = errors.New("invalid relay key file")
+	ErrNoSpool          = errors.New("a spool directory is required when relaying events")
+)
+
+// relayEvent is an event forwarded by a relay to the upstream server, along
+// with the source and receipt time recorded by the relay, and an ID that is
+// unique to the event, so that the upstream server can ignore it if resent.
+type relayEvent struct {
+	ID               string `json:"id,omitempty"`
+	Username         string `json:"username"`
+	Command          string `json:"command"`
+	IP               string `json:"ip"`
+	Time             int64  `json:"time"`
+	Received         int64  `json:"received"`
+	Hostname         string `json:"hostname,omitempty"`
+	Cwd              string `json:"cwd,omitempty"`
+	JobID            string `json:"jobid,omitempty"`
+	Version          string `json:"version,omitempty"`
+	Flags            string `json:"flags,omitempty"`
+	VerifiedUsername string `json:"verified_username,omitempty"`
+}
+
+func newRelayEvent(e Event) relayEvent {
+	return relayEvent{
+		Username:         e.Username,
+		Command:          e.Command,
+		IP:               e.IP,
+		Time:             e.Time,
+		Received:         e.Received,
+		Hostname:         e.Hostname,
+		Cwd:              e.Cwd,
+		JobID:            e.JobID,
+		Version:          e.Version,
+		Flags:            e.Flags,
+		VerifiedUsername: e.VerifiedUsername,
+	}
+}
+
+func (r relayEvent) event() Event {
+	return Event{
+		Username:         r.Username,
+		Command:          r.Command,
+		IP:               r.IP,
+		Time:             r.Time,
+		Received:         r.Received,
+		Hostname:         r.Hostname,
+		Cwd:              r.Cwd,
+		JobID:            r.JobID,
+		Version:          r.Version,
+		Flags:            r.Flags,
+		VerifiedUsername: r.VerifiedUsername,
+		RelayID:          r.ID,
+	}
+}
+
+// spool is a directory of batches of events waiting to be forwarded upstream,
+// each stored as a JSON array in its own file, named so that they sort in the
+// order they were written.
+type spool struct {
+	dir string
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+
+	return &spool{dir: dir}, nil
+}
+
+// AddEvents writes the events to a new batch file, which is synced to disk
+// before being renamed into place, so that it is either written in full or not
+// at all. Each event is given an ID made of a random batch ID and its index in
+// the batch.
+func (s *spool) AddEvents(events []Event) error {
+	id := make([]byte, batchIDSize)
+
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	batch := make([]relayEvent, len(events))
+
+	for n, e := range events {
+		batch[n] = newRelayEvent(e)
+		batch[n].ID = hex.EncodeToString(id) + "-" + strconv.Itoa(n)
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.seq++
+	name := fmt.Sprintf("%019d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spoolExt)
+	s.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(s.dir, name), data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// batches returns the paths of the batch files, oldest first.
+func (s *spool) batches() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	for _, entry := range entries {
+		if name := entry.Name(); entry.Type().IsRegular() && strings.HasSuffix(name, spoolExt) &&
+			!strings.HasPrefix(name, ".") {
+			paths = append(paths, filepath.Join(s.dir, name))
+		}
+	}
+
+	return paths, nil
+}
+
+// Len returns the number of batches waiting to be forwarded.
+func (s *spool) Len() int {
+	paths, _ := s.batches() //nolint:errcheck
+
+	return len(paths)
+}
+
+// relayKey is the key a relay signs its requests to the upstream server with.
+type relayKey struct {
+	ID     string
+	Secret []byte
+}
+
+// loadRelayKey reads a key from a file in the same format as the keys file, but
+// which must contain only a single key. No key is returned if no path is given.
+func loadRelayKey(path string) (relayKey, error) {
+	if path == "" {
+		return relayKey{}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return relayKey{}, err
+	}
+
+	defer f.Close()
+
+	keys, err := parseKeys(f)
+	if err != nil {
+		return relayKey{}, err
+	} else if len(keys) != 1 {
+		return relayKey{}, fmt.Errorf("%w: expecting 1 key, got %d", ErrRelayKey, len(keys))
+	}
+
+	for id, secret := range keys {
+		return relayKey{ID: id, Secret: secret}, nil
+	}
+
+	return relayKey{}, nil
+}
+
+// forwardConfig configures a forwarder. Zero values are replaced by the
+// defaults.
+type forwardConfig struct {
+	// Interval is how often the spool is checked for new batches.
+	Interval time.Duration
+
+	// MaxBackoff is the longest time to wait between attempts when the
+	// upstream server cannot be reached; the wait doubles, from Interval, after
+	// each failed attempt.
+	MaxBackoff time.Duration
+}
+
+func (c forwardConfig) withDefaults() forwardConfig {
+	if c.Interval <= 0 {
+		c.Interval = defaultForwardInterval
+	}
+
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+
+	return c
+}
+
+// forwarder sends the batches in a spool to the upstream server, removing them
+// once they have been accepted.
+type forwarder struct {
+	spool    *spool
+	upstream string
+	key      relayKey
+	metrics  *metrics
+	config   forwardConfig
+	client   *http.Client
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+func newForwarder(s *spool, upstream string, key relayKey, m *metrics, config forwardConfig) *forwarder {
+	f := &forwarder{
+		spool:    s,
+		upstream: strings.TrimSuffix(upstream, "/") + relayPath,
+		key:      key,
+		metrics:  m,
+		config:   config.withDefaults(),
+		client:   &http.Client{Timeout: forwardTimeout},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go f.run()
+
+	return f
+}
+
+func (f *forwarder) run() {
+	defer close(f.stopped)
+
+	var backoff time.Duration
+
+	for {
+		wait := f.config.Interval
+
+		if err := f.forwardAll(); err != nil {
+			backoff = min(max(2*backoff, f.config.Interval), f.config.MaxBackoff)
+			wait = backoff
+
+			slog.Warn("error forwarding events", "err", err, "retry", backoff)
+		} else {
+			backoff = 0
+		}
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// forwardAll sends each batch in the spool, oldest first, stopping at the first
+// that could not be sent. Batches rejected by the upstream server are renamed,
+// so that they are kept but not retried.
+func (f *forwarder) forwardAll() error {
+	paths, err := f.spool.batches()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		select {
+		case <-f.done:
+			return nil
+		default:
+		}
+
+		n, err := f.forward(path)
+		if errors.Is(err, ErrUpstreamRejected) {
+			slog.Error("upstream rejected batch of events", "err", err, "batch", path)
+
+			if err := os.Rename(path, path+rejectedExt); err != nil {
+				return err
+			}
+
+			continue
+		} else if err != nil {
+			f.metrics.forwardErrors.Inc()
+
+			return err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		f.metrics.forwarded.Add(float64(n))
+	}
+
+	return nil
+}
+
+// forward sends a single batch file, returning the number of events in it.
+func (f *forwarder) forward(path string) (int, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []json.RawMessage
+
+	if err := json.Unmarshal(body, &events); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrUpstreamRejected, err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, f.upstream, bytes.NewReader(body)) //nolint:noctx
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if f.key.ID != "" {
+		req.Header.Set(signatureHeader, f.key.ID+":"+hex.EncodeToString(analytics.Sign(f.key.Secret, body)))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxPayloadSize)) //nolint:errcheck
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest:
+		return 0, fmt.Errorf("%w: %s", ErrUpstreamRejected, bytes.TrimSpace(msg))
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return 0, fmt.Errorf("%w: %s: %s", ErrUpstream, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return len(events), nil
+}
+
+// Close stops forwarding; any batches not yet forwarded remain in the spool.
+func (f *forwarder) Close() {
+	close(f.done)
+	<-f.stopped
+}
+
+// newRelayHandler returns a handler that accepts batches of events forwarded by
+// relays in the given trusted networks, recording them with the sources and
+// times recorded by the relay.
+//
+// As a relay resends any batch it did not see accepted, each batch is written to
+// the database before it is acknowledged, skipping events whose relay IDs are
+// already recorded.
+func newRelayHandler(in *ingester, db *DB, relays []*net.IPNet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		ip := net.ParseIP(remoteIP(r))
+		if ip == nil || !containsIP(relays, ip) {
+			in.metrics.dropped.WithLabelValues(dropDenied).Inc()
+			http.Error(w, ErrSourceDenied.Error(), http.StatusForbidden)
+
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRelayBodySize))
+		if err != nil {
+			in.metrics.reject("read_error")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		flags, err := in.config.Auth.verifySignature(body, r.Header.Get(signatureHeader))
+		if err != nil {
+			in.metrics.reject(authReason(err))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		}
+
+		var events []relayEvent
+
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(&events); err != nil {
+			in.metrics.reject("invalid_json")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		batch := make([]Event, 0, len(events))
+
+		for _, e := range events {
+			if e, ok := in.relayed(e.event(), flags...); ok {
+				batch = append(batch, e)
+			}
+		}
+
+		if _, err := db.RelayEvents(batch); err != nil {
+			in.metrics.dbErrors.Inc()
+			slog.Error("error writing relayed events to database", "err", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// relayed classifies an event forwarded by a relay, which will have already
+// checked it, adding the given flags to any set by the relay. Returns false if
+// the event is invalid.
+func (i *ingester) relayed(e Event, flags ...string) (Event, bool) {
+	if e.Username == "" || e.Command == "" {
+		i.metrics.reject("invalid_event")
+
+		return e, false
+	}
+
+	i.metrics.parsed.Inc()
+
+	if e.Flags != "" {
+		flags = append(strings.Split(e.Flags, ","), flags...)
+	}
+
+	for _, flag := range flags {
+		i.metrics.flagged.WithLabelValues(flag).Inc()
+	}
+
+	if e.Received == 0 {
+		e.Received = i.now().Unix()
+	}
+
+	if e.Time == 0 {
+		e.Time = e.Received
+	}
+
+	e.Flags = strings.Join(flags, ",")
+	e.Category, e.Module = i.rules.Classify(e.Command)
+
+	return e, true
+}
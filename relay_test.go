@@ -0,0 +1,197 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	relays, err := parseCIDRs("127.0.0.1,::1")
+	if err != nil {
+		t.Fatalf("unexpected error parsing CIDRs: %s", err)
+	}
+
+	central := newIngester(db, rules, newMetrics(db), ingestConfig{})
+	handler := newRelayHandler(central, db, relays)
+
+	var up atomic.Bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		handler(w, r)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("unexpected error creating spool: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "0-bad"+spoolExt), []byte("[{\"unknown\": 1}]"), 0600); err != nil {
+		t.Fatalf("unexpected error writing batch: %s", err)
+	}
+
+	m := newMetrics(nil)
+	m.registerSpool(sp)
+
+	fwd := newForwarder(sp, server.URL, relayKey{}, m, forwardConfig{Interval: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	defer fwd.Close()
+
+	relay := newIngester(sp, rules, m, ingestConfig{Queue: queueConfig{Interval: 10 * time.Millisecond}})
+	relay.now = func() time.Time { return time.Unix(1700000200, 0) }
+
+	relay.ingest("SPA1\x00user=USER\x00command=/path/to/command\x00time=1700000100", source{IP: "10.1.2.3"})
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := sp.Len(); n != 2 {
+		t.Errorf("expecting 2 batches in spool while upstream is down, got %d", n)
+	}
+
+	up.Store(true)
+
+	time.Sleep(250 * time.Millisecond)
+
+	if n := sp.Len(); n != 0 {
+		t.Errorf("expecting spool to be empty once upstream is up, got %d batches", n)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "0-bad"+spoolExt+rejectedExt)); err != nil {
+		t.Errorf("expecting rejected batch to be kept: %s", err)
+	}
+
+	central.Close()
+
+	expected := regexp.MustCompile("^USER,/path/to/command,10.1.2.3,1700000100,ignore,,,,,,1700000200,,<nil>," +
+		"[0-9a-f]{32}-0\n$")
+
+	if out := dumpTable(t, db, "events"); !expected.MatchString(out) {
+		t.Errorf("expecting events table to match %q, got %q", expected, out)
+	}
+}
+
+func TestRelayHandlerUntrusted(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	relays, err := parseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("unexpected error parsing CIDRs: %s", err)
+	}
+
+	server := httptest.NewServer(newRelayHandler(newIngester(db, rules, newMetrics(db), ingestConfig{}), db, relays))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/json", //nolint:noctx
+		strings.NewReader(`[{"username":"USER","command":"/path","ip":"10.1.2.3","time":1,"received":1}]`))
+	if err != nil {
+		t.Fatalf("unexpected error posting events: %s", err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expecting status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestRelayHandlerResend(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	relays, err := parseCIDRs("127.0.0.1,::1")
+	if err != nil {
+		t.Fatalf("unexpected error parsing CIDRs: %s", err)
+	}
+
+	server := httptest.NewServer(newRelayHandler(newIngester(db, rules, newMetrics(db), ingestConfig{}), db, relays))
+	defer server.Close()
+
+	batch := `[{"id":"a-0","username":"USER","command":"/path/a","ip":"10.1.2.3","time":1700000100,` +
+		`"received":1700000200},{"id":"a-1","username":"USER","command":"/path/a","ip":"10.1.2.3",` +
+		`"time":1700000100,"received":1700000200}]`
+
+	for n := 0; n < 2; n++ {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(batch)) //nolint:noctx
+		if err != nil {
+			t.Fatalf("unexpected error posting events: %s", err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("test %d: expecting status %d, got %d", n+1, http.StatusNoContent, resp.StatusCode)
+		}
+	}
+
+	expected := "USER,/path/a,10.1.2.3,1700000100,ignore,,,,,,1700000200,,<nil>,a-0\n" +
+		"USER,/path/a,10.1.2.3,1700000100,ignore,,,,,,1700000200,,<nil>,a-1\n"
+
+	if out := dumpTable(t, db, "events"); out != expected {
+		t.Errorf("expecting events table to be %q, got %q", expected, out)
+	}
+}
@@ -0,0 +1,127 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultReportLimit = 10
+
+func runReport(args []string) error {
+	flags := newFlagSet("report", "", "Prints the most used modules in each category of the database, "+
+		"with the number of users and uses of each.")
+	output := flags.String("d", "", "db file")
+	rulesFile := flags.String("r", "", "classification rules file")
+	category := flags.String("c", "", "only report on this category")
+	from := flags.String("from", "", "only count events at or after this time (YYYY-MM-DD [HH:MM:SS])")
+	to := flags.String("to", "", "only count events before this time (YYYY-MM-DD [HH:MM:SS])")
+	limit := flags.Int("n", defaultReportLimit, "number of modules to report in each category (all if 0)")
+	timeColumn := flags.String("time", "event",
+		"time to count events by: event (as sent by the client) or received (by the server)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return ErrNoDatabase
+	}
+
+	rules, err := LoadRules(*rulesFile)
+	if err != nil {
+		return fmt.Errorf("error loading rules: %w", err)
+	}
+
+	q := QueryOptions{Limit: *limit}
+
+	switch *timeColumn {
+	case "event":
+	case "received":
+		q.Received = true
+	default:
+		return fmt.Errorf("%w: -time must be event or received", ErrBadParameter)
+	}
+
+	if q.From, err = parseTimeFlag(*from); err != nil {
+		return fmt.Errorf("invalid -from time: %w", err)
+	}
+
+	if q.To, err = parseTimeFlag(*to); err != nil {
+		return fmt.Errorf("invalid -to time: %w", err)
+	}
+
+	db, err := OpenDBReadOnly(*output)
+	if err != nil {
+		return fmt.Errorf("error opening database (%s): %w", *output, err)
+	}
+
+	defer db.Close()
+
+	categories := []string{*category}
+
+	if *category == "" {
+		categories = slices.DeleteFunc(rules.Categories(), func(c string) bool {
+			return !slices.Contains(db.Categories(), c)
+		})
+	}
+
+	return writeReport(db, os.Stdout, categories, q)
+}
+
+// writeReport writes a table of the top modules in each of the given categories.
+func writeReport(db *DB, w io.Writer, categories []string, q QueryOptions) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	for n, category := range categories {
+		modules, err := db.TopModules(category, q)
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			fmt.Fprintln(tw)
+		}
+
+		fmt.Fprintf(tw, "%s\nMODULE\tUSERS\tUSES\tFIRST USE\tLAST USE\n", category)
+
+		for _, m := range modules {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", m.Module, m.Users, m.Count, formatTime(m.FirstUse), formatTime(m.LastUse))
+		}
+	}
+
+	return tw.Flush()
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).Format(time.DateTime)
+}
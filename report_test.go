@@ -0,0 +1,75 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteReport(t *testing.T) {
+	db, err := NewDB(":memory:", "other", "apptainer")
+	if err != nil {
+		t.Fatalf("unexpected error creating DB: %s", err)
+	}
+
+	for n, event := range [...]struct {
+		Username, Category, Module string
+		Time                       int64
+	}{
+		{"userA", "other", "x", 1700000000},
+		{"userB", "other", "x", 1700000100},
+		{"userA", "other", "y", 1700000200},
+		{"userA", "apptainer", "z", 1700000300},
+	} {
+		if err := db.Add(event.Username, "/"+event.Module, event.Category, event.Module, "", event.Time); err != nil {
+			t.Fatalf("test %d: unexpected error adding event: %s", n+1, err)
+		}
+	}
+
+	var sb strings.Builder
+
+	if err := writeReport(db, &sb, []string{"other", "apptainer"}, QueryOptions{Limit: 1}); err != nil {
+		t.Fatalf("unexpected error writing report: %s", err)
+	}
+
+	expected := "other\n" +
+		"MODULE  USERS  USES  FIRST USE            LAST USE\n" +
+		"x       2      2     " + formatTime(1700000000) + "  " + formatTime(1700000100) + "\n" +
+		"\n" +
+		"apptainer\n" +
+		"MODULE  USERS  USES  FIRST USE            LAST USE\n" +
+		"z       1      1     " + formatTime(1700000300) + "  " + formatTime(1700000300) + "\n"
+
+	if out := sb.String(); out != expected {
+		t.Errorf("expecting report:\n%s\ngot:\n%s", expected, out)
+	}
+
+	if err := writeReport(db, &sb, []string{"missing"}, QueryOptions{}); err == nil {
+		t.Errorf("expecting error reporting on unknown category")
+	}
+}
@@ -0,0 +1,224 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed defaultrules.yml
+var defaultRules []byte
+
+// CategoryIgnore is the reserved category for commands that should be recorded
+// as events only.
+const CategoryIgnore = "ignore"
+
+var (
+	ErrInvalidRule = errors.New("invalid rule")
+
+	templateRef = regexp.MustCompile(`\$(?:\$|\{(\w+)\}|(\w+))`)
+)
+
+// Rule is a single classification rule, which maps a matching command to a
+// category and module name.
+type Rule struct {
+	Prefix   string `yaml:"prefix"`
+	Regex    string `yaml:"regex"`
+	Dir      bool   `yaml:"dir"`
+	Category string `yaml:"category"`
+	Module   string `yaml:"module"`
+
+	re *regexp.Regexp
+}
+
+// RuleSet is an ordered list of classification rules.
+type RuleSet struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// LoadRules reads and validates the rules file at the given path. An empty path
+// returns the default rules.
+func LoadRules(path string) (*RuleSet, error) {
+	if path == "" {
+		return ParseRules(bytes.NewReader(defaultRules))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ParseRules(f)
+}
+
+// ParseRules reads a YAML rules file from the given reader, returning an error
+// if any of the rules are invalid.
+func ParseRules(r io.Reader) (*RuleSet, error) {
+	var rs RuleSet
+
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&rs); err != nil {
+		return nil, fmt.Errorf("error decoding rules: %w", err)
+	}
+
+	for n, rule := range rs.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", n+1, err)
+		}
+	}
+
+	return &rs, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Category == "" {
+		return fmt.Errorf("%w: missing category", ErrInvalidRule)
+	} else if !validCategory(r.Category) {
+		return fmt.Errorf("%w: invalid category name %q", ErrInvalidRule, r.Category)
+	}
+
+	if (r.Prefix == "") == (r.Regex == "") {
+		return fmt.Errorf("%w: exactly one of prefix or regex must be set", ErrInvalidRule)
+	}
+
+	if r.Prefix != "" {
+		return nil
+	}
+
+	var err error
+
+	if r.re, err = regexp.Compile(r.Regex); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRule, err)
+	}
+
+	if r.Module == "" && r.re.NumSubexp() > 0 {
+		r.Module = "${1}"
+	}
+
+	if r.Module == "" && r.Category != CategoryIgnore {
+		return fmt.Errorf("%w: regex without a capture group requires a module", ErrInvalidRule)
+	}
+
+	return r.checkTemplate()
+}
+
+func (r *Rule) checkTemplate() error {
+	for _, ref := range templateRef.FindAllStringSubmatch(r.Module, -1) {
+		name := ref[1] + ref[2]
+
+		if name == "" {
+			continue
+		}
+
+		if n, err := strconv.Atoi(name); err == nil {
+			if n > r.re.NumSubexp() {
+				return fmt.Errorf("%w: module template refers to missing group %d", ErrInvalidRule, n)
+			}
+		} else if r.re.SubexpIndex(name) == -1 {
+			return fmt.Errorf("%w: module template refers to missing group %q", ErrInvalidRule, name)
+		}
+	}
+
+	return nil
+}
+
+func (r *Rule) match(command string) (string, bool) {
+	if r.Dir {
+		command = filepath.Dir(command)
+	}
+
+	if r.re == nil {
+		if !strings.HasPrefix(command, r.Prefix) {
+			return "", false
+		}
+
+		if r.Module != "" {
+			return r.Module, true
+		}
+
+		return strings.TrimPrefix(command, r.Prefix), true
+	}
+
+	match := r.re.FindStringSubmatchIndex(command)
+	if match == nil {
+		return "", false
+	}
+
+	return string(r.re.ExpandString(nil, r.Module, command, match)), true
+}
+
+// Categories returns the distinct categories used by the rules, in the order
+// they first appear, excluding the ignore category.
+func (rs *RuleSet) Categories() []string {
+	var categories []string
+
+	seen := map[string]bool{CategoryIgnore: true}
+
+	for _, rule := range rs.Rules {
+		if !seen[rule.Category] {
+			seen[rule.Category] = true
+			categories = append(categories, rule.Category)
+		}
+	}
+
+	return categories
+}
+
+// Classify returns the category and module of the given command, as determined
+// by the first matching rule. Commands that match no rule, or that produce an
+// empty module name, are returned with the ignore category.
+func (rs *RuleSet) Classify(command string) (string, string) {
+	for _, rule := range rs.Rules {
+		module, ok := rule.match(command)
+		if !ok {
+			continue
+		}
+
+		if module == "" || rule.Category == CategoryIgnore {
+			return CategoryIgnore, ""
+		}
+
+		return rule.Category, module
+	}
+
+	return CategoryIgnore, ""
+}
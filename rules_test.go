@@ -0,0 +1,194 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDefaultRules(t *testing.T) {
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading default rules: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		Command          string
+		ExpectedCategory string
+		ExpectedModule   string
+	}{
+		{
+			"/software/hgi/installs/conda-audited/miniconda/bin/conda shell.bash hook",
+			CategoryIgnore,
+			"",
+		},
+		{
+			"/software/hgi/installs/conda-audited/miniconda/bin/conda shell.posix activate /path/to/env",
+			"conda",
+			"/path/to/env",
+		},
+		{
+			"/software/hgi/installs/conda-audited/miniforge/bin/conda shell.posix activate myenv",
+			"conda",
+			"myenv",
+		},
+		{
+			"/software/hgi/installs/conda-audited/miniconda/bin/conda shell.posix activate /home/a/.snakemake/conda/abc123",
+			"conda",
+			"/home/a",
+		},
+		{
+			"/software/hgi/installs/conda-audited/miniconda/bin/python",
+			"other",
+			"conda-audited",
+		},
+		{
+			"/software/hgi/installs/micromamba/micromamba shell hook",
+			"other",
+			"micromamba",
+		},
+		{
+			"/software/hgi/softpack/installs/users/userA/myenv/1-scripts/python",
+			"softpack",
+			"users/userA/myenv/1",
+		},
+		{
+			"/software/hgi/softpack/installs/groups/hgi/env/2/R",
+			"softpack",
+			"groups/hgi/env/2",
+		},
+		{
+			"/software/hgi/installs/samtools-scripts/samtools",
+			"other",
+			"samtools",
+		},
+		{
+			"/usr/bin/ls",
+			CategoryIgnore,
+			"",
+		},
+	} {
+		category, module := rules.Classify(test.Command)
+		if category != test.ExpectedCategory {
+			t.Errorf("test %d: expecting category %q, got %q", n+1, test.ExpectedCategory, category)
+		} else if module != test.ExpectedModule {
+			t.Errorf("test %d: expecting module %q, got %q", n+1, test.ExpectedModule, module)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	for n, test := range [...]struct {
+		Input          string
+		Command        string
+		ExpectedError  bool
+		ExpectedModule string
+	}{
+		{
+			Input:          "rules:\n  - prefix: /opt/\n    category: other\n",
+			Command:        "/opt/tool",
+			ExpectedModule: "tool",
+		},
+		{
+			Input:          "rules:\n  - regex: '^/opt/(?P<name>[^/]+)/'\n    module: 'tool-${name}'\n    category: other\n",
+			Command:        "/opt/abc/bin/abc",
+			ExpectedModule: "tool-abc",
+		},
+		{
+			Input:         "rules:\n  - prefix: /opt/\n",
+			ExpectedError: true,
+		},
+		{
+			Input:         "rules:\n  - prefix: /opt/\n    category: 'bad name'\n",
+			ExpectedError: true,
+		},
+		{
+			Input:         "rules:\n  - prefix: /opt/\n    regex: /opt/\n    category: other\n",
+			ExpectedError: true,
+		},
+		{
+			Input:         "rules:\n  - regex: '(/opt/'\n    category: other\n",
+			ExpectedError: true,
+		},
+		{
+			Input:         "rules:\n  - regex: '/opt/(.*)'\n    module: $2\n    category: other\n",
+			ExpectedError: true,
+		},
+		{
+			Input:         "rules:\n  - regex: '/opt/(.*)'\n    module: ${name}\n    category: other\n",
+			ExpectedError: true,
+		},
+		{
+			Input:         "rules:\n  - prefx: /opt/\n    category: other\n",
+			ExpectedError: true,
+		},
+		{
+			Input:         "rules:\n  - regex: '^/opt/'\n    category: other\n",
+			ExpectedError: true,
+		},
+		{
+			Input:   "rules:\n  - regex: '^/opt/'\n    category: ignore\n",
+			Command: "/opt/tool",
+		},
+	} {
+		rules, err := ParseRules(strings.NewReader(test.Input))
+		if test.ExpectedError {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+
+			continue
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if _, module := rules.Classify(test.Command); module != test.ExpectedModule {
+			t.Errorf("test %d: expecting module %q, got %q", n+1, test.ExpectedModule, module)
+		}
+	}
+
+	rules, err := ParseRules(strings.NewReader("rules:\n" +
+		"  - prefix: /a/\n    category: apptainer\n" +
+		"  - prefix: /b/\n    category: ignore\n" +
+		"  - prefix: /c/\n    category: rlibs\n" +
+		"  - prefix: /d/\n    category: apptainer\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if categories := strings.Join(rules.Categories(), ","); categories != "apptainer,rlibs" {
+		t.Errorf("expecting categories %q, got %q", "apptainer,rlibs", categories)
+	}
+
+	if _, err := ParseRules(strings.NewReader("rules:\n  - prefix: /opt/\n")); !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("expecting ErrInvalidRule, got %v", err)
+	}
+}
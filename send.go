@@ -0,0 +1,235 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
+)
+
+const (
+	defaultSendTimeout = 500 * time.Millisecond
+
+	// envServer and envSpool provide the defaults for the -s and -spool flags
+	// of the send command, so that they can be set once for all wrappers.
+	envServer = "SOFTPACK_ANALYTICS_SERVER"
+	envSpool  = "SOFTPACK_ANALYTICS_SPOOL"
+)
+
+var (
+	ErrNoServer  = errors.New("no server address given")
+	ErrNoCommand = errors.New("no command given and none could be determined")
+)
+
+// jobIDVars are the environment variables, in order of preference, that
+// contain the ID of the scheduler job a command is running in.
+var jobIDVars = [...]string{"LSB_JOBID", "SLURM_JOB_ID", "PBS_JOBID", "JOB_ID"}
+
+// shells are the interpreters whose first argument, rather than themselves, is
+// taken to be the command when a wrapper script runs the send command.
+var shells = map[string]bool{"sh": true, "bash": true, "dash": true, "zsh": true, "ksh": true}
+
+// sendConfig contains the flags of the send command.
+type sendConfig struct {
+	Server, Network  string
+	Timeout          time.Duration
+	SpoolDir         string
+	KeyFile          string
+	TLS              bool
+	TLSCA            string
+	Legacy           bool
+	Command, Version string
+}
+
+// runSend sends an event as configured by the given arguments. So that wrapper
+// scripts are not affected when the server cannot be reached, or the command is
+// not configured, failures to send are logged but not returned.
+func runSend(args []string) error {
+	var config sendConfig
+
+	flags := newFlagSet("send", " [command]",
+		"Sends a single event for the command, or the script that ran send, to the server.")
+	flags.StringVar(&config.Server, "s", os.Getenv(envServer),
+		"address (host:port, or path for -network unix) of the analytics server")
+	flags.StringVar(&config.Network, "network", "tcp", "network of the server: tcp, udp or unix")
+	flags.DurationVar(&config.Timeout, "timeout", defaultSendTimeout,
+		"how long connecting to and sending to the server may take")
+	flags.StringVar(&config.SpoolDir, "spool", os.Getenv(envSpool),
+		"directory to keep events in when the server cannot be reached")
+	flags.StringVar(&config.KeyFile, "key", "", "file containing the key ID and secret to sign events with")
+	flags.BoolVar(&config.TLS, "tls", false, "connect to the server with TLS")
+	flags.StringVar(&config.TLSCA, "tls-ca", "",
+		"PEM CA bundle to verify the server certificate with, instead of the system roots")
+	flags.BoolVar(&config.Legacy, "legacy", false,
+		"send only the username and command, for servers without the extended protocol")
+	flags.StringVar(&config.Version, "version", "", "version of the module the command belongs to")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config.Command = flags.Arg(0)
+
+	if err := sendEvent(config); err != nil {
+		slog.Warn("event not sent", "err", err)
+	}
+
+	return nil
+}
+
+// sendEvent sends a single event, returning an error if it could be neither
+// sent nor spooled.
+func sendEvent(sc sendConfig) error {
+	if sc.Server == "" {
+		return ErrNoServer
+	}
+
+	p, err := collectPayload(sc.Command)
+	if err != nil {
+		return err
+	}
+
+	p.Version = sc.Version
+
+	config := analytics.Config{
+		Network:  sc.Network,
+		Addr:     sc.Server,
+		Timeout:  sc.Timeout,
+		Legacy:   sc.Legacy,
+		SpoolDir: sc.SpoolDir,
+	}
+
+	key, err := loadRelayKey(sc.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading key: %w", err)
+	}
+
+	config.KeyID, config.Secret = key.ID, key.Secret
+
+	if sc.TLS || sc.TLSCA != "" {
+		if config.TLS, err = clientTLSConfig(sc.TLSCA); err != nil {
+			return err
+		}
+	}
+
+	c := analytics.NewClient(config)
+	defer c.Close()
+
+	if err := c.SendSync(p); err != nil && !errors.Is(err, analytics.ErrSpooled) {
+		return fmt.Errorf("error sending event: %w", err)
+	}
+
+	return nil
+}
+
+// collectPayload returns an event for the given command, or that of the parent
+// process if none is given, run by the current user on this host.
+func collectPayload(command string) (analytics.Payload, error) {
+	if command == "" {
+		command = parentCommand()
+	}
+
+	if command == "" {
+		return analytics.Payload{}, ErrNoCommand
+	}
+
+	if abs, err := filepath.Abs(command); err == nil && filepath.Base(command) != command {
+		command = abs
+	}
+
+	p := analytics.Payload{
+		Username: os.Getenv("USER"),
+		Command:  command,
+	}
+
+	if u, err := user.Current(); err == nil {
+		p.Username = u.Username
+	}
+
+	p.Hostname, _ = os.Hostname() //nolint:errcheck
+	p.Cwd, _ = os.Getwd()         //nolint:errcheck
+
+	for _, v := range jobIDVars {
+		if p.JobID = os.Getenv(v); p.JobID != "" {
+			break
+		}
+	}
+
+	return p, nil
+}
+
+// parentCommand returns the command line path of the parent process, which, if
+// it is a shell running a script, is the path of the script. Returns an empty
+// string where /proc is not available.
+func parentCommand() string {
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(os.Getppid()), "cmdline"))
+	if err != nil {
+		return ""
+	}
+
+	args := bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0})
+
+	if len(args) > 1 && shells[filepath.Base(string(args[0]))] && !bytes.HasPrefix(args[1], []byte("-")) {
+		return string(args[1])
+	}
+
+	return string(args[0])
+}
+
+// clientTLSConfig returns the TLS configuration used to connect to the server,
+// verifying its certificate against the given CA bundle, if given.
+func clientTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+
+	config.RootCAs = x509.NewCertPool()
+
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%w: no certificates found in CA bundle %s", ErrTLSConfig, caFile)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,151 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunSend(t *testing.T) {
+	for _, v := range jobIDVars {
+		t.Setenv(v, "")
+	}
+
+	t.Setenv("SLURM_JOB_ID", "456")
+	t.Setenv(envServer, "")
+	t.Setenv(envSpool, "")
+
+	p, err := collectPayload("/path/to/command")
+	if err != nil {
+		t.Fatalf("unexpected error collecting payload: %s", err)
+	}
+
+	host, _ := os.Hostname() //nolint:errcheck
+	cwd, _ := os.Getwd()     //nolint:errcheck
+
+	if p.Username == "" || p.Hostname != host || p.Cwd != cwd || p.JobID != "456" {
+		t.Errorf("expecting payload to be collected from the environment, got %+v", p)
+	}
+
+	if err := sendEvent(sendConfig{Command: "/path/to/command"}); !errors.Is(err, ErrNoServer) {
+		t.Errorf("expecting no server error, got %v", err)
+	}
+
+	if err := runSend([]string{"/path/to/command"}); err != nil {
+		t.Errorf("expecting send without a server to only log an error, got %s", err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	addr := l.Addr().String()
+	spoolDir := t.TempDir()
+
+	l.Close()
+
+	if err := sendEvent(sendConfig{Server: addr, Timeout: 100 * time.Millisecond, Command: "/path/to/a"}); err == nil {
+		t.Errorf("expecting error sending to closed port without a spool")
+	}
+
+	if err := runSend([]string{"-s", addr, "-timeout", "100ms", "/path/to/a"}); err != nil {
+		t.Errorf("expecting failed send to only log an error, got %s", err)
+	}
+
+	if err := runSend([]string{"-s", addr, "-timeout", "100ms", "-spool", spoolDir, "/path/to/a"}); err != nil {
+		t.Errorf("expecting no error when event is spooled, got %s", err)
+	}
+
+	if paths, _ := filepath.Glob(filepath.Join(spoolDir, "*")); len(paths) != 1 { //nolint:errcheck
+		t.Fatalf("expecting 1 spooled event, got %d", len(paths))
+	}
+
+	if l, err = net.ListenTCP("tcp", l.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{})
+
+	go newAnalyticsServer(l, in)
+
+	if err := runSend([]string{"-s", addr, "-spool", spoolDir, "-version", "1.0", "/path/to/b"}); err != nil {
+		t.Fatalf("unexpected error sending event: %s", err)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	in.Close()
+
+	rows, err := db.db.Query("SELECT username, command, hostname, cwd, jobid, version FROM events ORDER BY command")
+	if err != nil {
+		t.Fatalf("unexpected error querying events: %s", err)
+	}
+
+	defer rows.Close()
+
+	var got []string
+
+	for rows.Next() {
+		var username, command, host, cwd, jobid, version string
+
+		if err := rows.Scan(&username, &command, &host, &cwd, &jobid, &version); err != nil {
+			t.Fatalf("unexpected error scanning event: %s", err)
+		}
+
+		got = append(got, username+","+command+","+host+","+cwd+","+jobid+","+version)
+	}
+
+	for n, expected := range [...]string{
+		p.Username + ",/path/to/a," + host + "," + cwd + ",456,",
+		p.Username + ",/path/to/b," + host + "," + cwd + ",456,1.0",
+	} {
+		if n >= len(got) {
+			t.Errorf("event %d: expecting %q, got nothing", n+1, expected)
+		} else if got[n] != expected {
+			t.Errorf("event %d: expecting %q, got %q", n+1, expected, got[n])
+		}
+	}
+
+	if paths, _ := filepath.Glob(filepath.Join(spoolDir, "*")); len(paths) != 0 { //nolint:errcheck
+		t.Errorf("expecting spool to be empty, got %d events", len(paths))
+	}
+}
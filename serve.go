@@ -0,0 +1,340 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// serveConfig contains the flags of the serve command.
+type serveConfig struct {
+	Port, UDPPort          uint64
+	UnixPath, UnixMode     string
+	HTTPAddr               string
+	TLSCert, TLSKey, TLSCA string
+	Proxy                  string
+
+	DB, RulesFile string
+	AuthMode      string
+	KeysFile      string
+	Allow, Deny   string
+	ConnPolicy    string
+	Ingest        ingestConfig
+
+	Upstream, SpoolDir, UpstreamKey string
+	Relays                          string
+}
+
+// register adds the flags of the serve command to the flag set.
+func (c *serveConfig) register(flags *flag.FlagSet) {
+	c.registerListeners(flags)
+	c.registerIngest(flags)
+	c.registerConns(flags)
+	c.registerRelay(flags)
+}
+
+func (c *serveConfig) registerListeners(flags *flag.FlagSet) {
+	flags.Uint64Var(&c.Port, "p", 1234, "port to listen on for analytics (disabled if 0)")
+	flags.StringVar(&c.UnixPath, "unix", "", "path of a Unix socket to listen on for analytics")
+	flags.StringVar(&c.UnixMode, "unix-mode", defaultUnixMode, "octal permissions of the -unix socket")
+	flags.Uint64Var(&c.UDPPort, "u", 0, "UDP port to listen on for analytics (disabled if 0)")
+	flags.StringVar(&c.HTTPAddr, "a", "", "address (host:port) to serve the HTTP API on")
+	flags.StringVar(&c.TLSCert, "tls-cert", "",
+		"PEM certificate file; if given with -tls-key, the TCP listener uses TLS")
+	flags.StringVar(&c.TLSKey, "tls-key", "", "PEM private key file for -tls-cert")
+	flags.StringVar(&c.TLSCA, "tls-ca", "",
+		"PEM CA bundle; if given, TLS clients must present a certificate signed by one of its CAs")
+	flags.StringVar(&c.Proxy, "proxy", "",
+		"comma-separated CIDRs of proxies trusted to send PROXY protocol headers")
+}
+
+func (c *serveConfig) registerIngest(flags *flag.FlagSet) {
+	flags.StringVar(&c.DB, "d", "", "db file")
+	flags.StringVar(&c.RulesFile, "r", "", "classification rules file")
+	flags.IntVar(&c.Ingest.Queue.Size, "queue-size", defaultQueueSize, "maximum number of events waiting to be written")
+	flags.IntVar(&c.Ingest.Queue.BatchSize, "batch-size", defaultBatchSize,
+		"maximum number of events written in each transaction")
+	flags.DurationVar(&c.Ingest.Queue.Interval, "batch-interval", defaultBatchInterval,
+		"maximum time events wait before being written")
+	flags.DurationVar(&c.Ingest.MaxSkew, "max-skew", defaultMaxSkew,
+		"how far in the future a client timestamp may be (unchecked if 0)")
+	flags.DurationVar(&c.Ingest.MaxAge, "max-age", defaultMaxAge,
+		"how far in the past a client timestamp may be (unchecked if 0)")
+	flags.BoolVar(&c.Ingest.RejectSkew, "reject-skew", false,
+		"reject, instead of flag, events with timestamps outside of -max-skew/-max-age")
+	flags.StringVar(&c.AuthMode, "auth", authOff,
+		"payload signature checking: off, grace (flag unsigned events) or require")
+	flags.StringVar(&c.KeysFile, "keys", "", "file of key IDs and secrets accepted for payload signatures")
+	flags.DurationVar(&c.Ingest.Ident, "ident", 0,
+		"how long to wait for an ident server on TCP client hosts to verify usernames (no lookups if 0)")
+}
+
+func (c *serveConfig) registerConns(flags *flag.FlagSet) {
+	flags.StringVar(&c.Allow, "allow", "", "comma-separated CIDRs allowed to send events (all if empty)")
+	flags.StringVar(&c.Deny, "deny", "", "comma-separated CIDRs not allowed to send events")
+	flags.Float64Var(&c.Ingest.Access.Rate, "rate", 0, "connections per second allowed from each IP (unlimited if 0)")
+	flags.IntVar(&c.Ingest.Access.Burst, "burst", defaultBurst,
+		"connections allowed at once from each IP when -rate is given")
+	flags.DurationVar(&c.Ingest.Access.DropLogInterval, "drop-log-interval", defaultDropLogInterval,
+		"how often to log a summary of dropped connections")
+	flags.DurationVar(&c.Ingest.Conns.ReadTimeout, "read-timeout", defaultReadTimeout,
+		"how long a TCP connection may be idle before it is closed (no limit if 0)")
+	flags.IntVar(&c.Ingest.Conns.MaxConns, "max-conns", 0,
+		"maximum number of TCP and Unix socket connections handled at once, across all listeners (no limit if 0)")
+	flags.StringVar(&c.ConnPolicy, "conn-policy", connPolicyBlock,
+		"what to do with new connections when -max-conns is reached: block or reject")
+	flags.DurationVar(&c.Ingest.Conns.DrainTimeout, "drain-timeout", defaultDrainTimeout,
+		"how long to wait for connections to finish when stopping (no limit if 0)")
+}
+
+func (c *serveConfig) registerRelay(flags *flag.FlagSet) {
+	flags.StringVar(&c.Upstream, "upstream", "",
+		"URL of an upstream server to relay events to, instead of writing them to -d")
+	flags.StringVar(&c.SpoolDir, "spool", "", "directory to keep events in until they are relayed to -upstream")
+	flags.StringVar(&c.UpstreamKey, "upstream-key", "",
+		"file containing the key ID and secret to sign requests to -upstream with")
+	flags.StringVar(&c.Relays, "relays", "", "comma-separated CIDRs of relays allowed to forward events")
+}
+
+func runServe(args []string) error {
+	var config serveConfig
+
+	flags := newFlagSet("serve", "", "Receives events and records them in the database given by -d, "+
+		"or relays them to the server given by -upstream.")
+	config.register(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return serve(config)
+}
+
+// serve receives events as configured until the listeners are closed by a
+// signal.
+func serve(c serveConfig) error {
+	rules, err := LoadRules(c.RulesFile)
+	if err != nil {
+		return fmt.Errorf("error loading rules: %w", err)
+	}
+
+	config, err := c.ingestConfig()
+	if err != nil {
+		return err
+	}
+
+	b, err := c.openBackend(rules)
+	if err != nil {
+		return err
+	}
+
+	defer b.Close()
+
+	socks, err := c.listen()
+	if err != nil {
+		return err
+	}
+
+	in := newIngester(b.writer, rules, b.metrics, config)
+	defer in.Close()
+
+	if socks.HTTP != nil {
+		defer stopHTTPServer(serveHTTP(socks.HTTP, b.handler(in)))
+	}
+
+	return serveSockets(in, socks)
+}
+
+// ingestConfig returns the configuration of the ingester, loading the keys and
+// parsing the networks given by the flags.
+func (c serveConfig) ingestConfig() (ingestConfig, error) {
+	config := c.Ingest
+
+	var err error
+
+	if config.Auth, err = newAuthenticator(c.AuthMode, c.KeysFile); err != nil {
+		return config, fmt.Errorf("error loading keys: %w", err)
+	}
+
+	if c.ConnPolicy != connPolicyBlock && c.ConnPolicy != connPolicyReject {
+		return config, fmt.Errorf("unknown connection policy %q", c.ConnPolicy)
+	}
+
+	config.Conns.RejectWhenFull = c.ConnPolicy == connPolicyReject
+
+	if config.Access.Allow, err = parseCIDRs(c.Allow); err != nil {
+		return config, fmt.Errorf("error parsing -allow: %w", err)
+	}
+
+	if config.Access.Deny, err = parseCIDRs(c.Deny); err != nil {
+		return config, fmt.Errorf("error parsing -deny: %w", err)
+	}
+
+	return config, nil
+}
+
+// listen opens the sockets passed by systemd or, if there are none, those given
+// by the flags.
+func (c serveConfig) listen() (*sockets, error) {
+	tlsConfig, err := newTLSConfig(c.TLSCert, c.TLSKey, c.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies, err := parseCIDRs(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing -proxy: %w", err)
+	}
+
+	wrapTCP := func(l net.Listener) net.Listener {
+		return withTLS(withProxyProtocol(l, proxies, c.Ingest.Conns.ReadTimeout), tlsConfig)
+	}
+
+	socks, err := systemdSockets(wrapTCP)
+	if err != nil {
+		return nil, fmt.Errorf("error using systemd sockets: %w", err)
+	} else if socks == nil {
+		if socks, err = listenSockets(c.Port, c.UDPPort, c.UnixPath, c.UnixMode, c.HTTPAddr, wrapTCP); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(socks.Stream) == 0 {
+		return nil, ErrNoListener
+	}
+
+	return socks, nil
+}
+
+// backend is where the server writes the events it receives: a database or,
+// when relaying, a spool that is forwarded upstream.
+type backend struct {
+	db        *DB
+	writer    eventWriter
+	metrics   *metrics
+	relays    []*net.IPNet
+	forwarder *forwarder
+}
+
+// openBackend opens the database given by the flags or, if an upstream server
+// is given, the spool of events to relay to it.
+func (c serveConfig) openBackend(rules *RuleSet) (*backend, error) {
+	relays, err := parseCIDRs(c.Relays)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing -relays: %w", err)
+	}
+
+	if c.Upstream != "" {
+		return c.openRelay()
+	}
+
+	db, err := NewDB(c.DB, rules.Categories()...)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database (%s): %w", c.DB, err)
+	}
+
+	return &backend{db: db, writer: db, metrics: newMetrics(db), relays: relays}, nil
+}
+
+func (c serveConfig) openRelay() (*backend, error) {
+	key, err := loadRelayKey(c.UpstreamKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading upstream key: %w", err)
+	} else if c.SpoolDir == "" {
+		return nil, ErrNoSpool
+	}
+
+	sp, err := newSpool(c.SpoolDir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMetrics(nil)
+	m.registerSpool(sp)
+
+	return &backend{writer: sp, metrics: m, forwarder: newForwarder(sp, c.Upstream, key, m, forwardConfig{})}, nil
+}
+
+// handler returns the handler of the HTTP listener; the API and the relay
+// endpoint are only served when writing to a database.
+func (b *backend) handler(in *ingester) http.Handler {
+	mux := http.NewServeMux()
+
+	if b.db != nil {
+		mux.Handle("/api/", newAPIHandler(b.db))
+		mux.Handle(relayPath, newRelayHandler(in, b.db, b.relays))
+	}
+
+	mux.Handle("/api/events", newIngestHandler(in))
+	mux.Handle("/metrics", b.metrics.handler())
+
+	return mux
+}
+
+// Close stops forwarding events and closes the database.
+func (b *backend) Close() {
+	if b.forwarder != nil {
+		b.forwarder.Close()
+	}
+
+	if b.db != nil {
+		b.db.Close()
+	}
+}
+
+// serveSockets handles connections to the listeners and datagrams sent to the
+// UDP sockets until they are closed by a signal.
+func serveSockets(in *ingester, socks *sockets) error {
+	go closeOnSignal(socks.closers()...)
+
+	slog.Info("Server Started…")
+	defer slog.Info("…Server Stopped")
+
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("error notifying systemd", "err", err)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, uc := range socks.UDP {
+		wg.Add(1)
+
+		go func(uc *net.UDPConn) {
+			defer wg.Done()
+
+			newUDPServer(uc, in) //nolint:errcheck
+		}(uc)
+	}
+
+	return serveListeners(in, socks.Stream...)
+}
@@ -0,0 +1,184 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by systemd.
+	listenFDsStart = 3
+
+	// fdNameHTTP is the FileDescriptorName of a socket on which to serve the
+	// HTTP API.
+	fdNameHTTP = "http"
+)
+
+var ErrUnsupportedSocket = errors.New("unsupported socket type")
+
+// sockets are the sockets that the server receives events on.
+type sockets struct {
+	Stream []net.Listener
+	UDP    []*net.UDPConn
+	HTTP   net.Listener
+}
+
+func (s *sockets) closers() []io.Closer {
+	closers := make([]io.Closer, 0, len(s.Stream)+len(s.UDP))
+
+	for _, l := range s.Stream {
+		closers = append(closers, l)
+	}
+
+	for _, uc := range s.UDP {
+		closers = append(closers, uc)
+	}
+
+	return closers
+}
+
+// systemdSockets returns the sockets passed to the process by systemd socket
+// activation, or nil if there are none. TCP listeners are wrapped with the given
+// function, and a stream socket named fdNameHTTP is used for the HTTP API.
+//
+// The environment variables used by socket activation are unset, so that child
+// processes do not try to use the sockets.
+func systemdSockets(wrapTCP func(net.Listener) net.Listener) (*sockets, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+
+	os.Unsetenv("LISTEN_PID")     //nolint:errcheck
+	os.Unsetenv("LISTEN_FDS")     //nolint:errcheck
+	os.Unsetenv("LISTEN_FDNAMES") //nolint:errcheck
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil //nolint:nilnil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	files := make([]*os.File, n)
+	fdNames := strings.Split(names, ":")
+
+	for i := range files {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+
+	return socketsFromFiles(files, wrapTCP)
+}
+
+// socketsFromFiles converts the given files into sockets, closing the files.
+func socketsFromFiles(files []*os.File, wrapTCP func(net.Listener) net.Listener) (*sockets, error) {
+	s := new(sockets)
+
+	for _, f := range files {
+		err := s.add(f, wrapTCP)
+
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("error using socket %s: %w", f.Name(), err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *sockets) add(f *os.File, wrapTCP func(net.Listener) net.Listener) error {
+	if l, err := net.FileListener(f); err == nil {
+		switch {
+		case f.Name() == fdNameHTTP && s.HTTP == nil:
+			s.HTTP = l
+		case isTCPListener(l):
+			s.Stream = append(s.Stream, wrapTCP(l))
+		default:
+			s.Stream = append(s.Stream, l)
+		}
+
+		return nil
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return err
+	}
+
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+
+		return fmt.Errorf("%w: %s", ErrUnsupportedSocket, pc.LocalAddr().Network())
+	}
+
+	s.UDP = append(s.UDP, uc)
+
+	return nil
+}
+
+func isTCPListener(l net.Listener) bool {
+	_, ok := l.(*net.TCPListener)
+
+	return ok
+}
+
+// sdNotify sends the given state to the systemd service manager, if the process
+// was started by one with a notification socket.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	_, err = c.Write([]byte(state))
+
+	return err
+}
@@ -0,0 +1,175 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSystemdSockets(t *testing.T) {
+	tl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating TCP listener: %s", err)
+	}
+
+	defer tl.Close()
+
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "sock"), Net: "unix"})
+	if err != nil {
+		t.Fatalf("unexpected error creating Unix listener: %s", err)
+	}
+
+	defer ul.Close()
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating UDP socket: %s", err)
+	}
+
+	defer uc.Close()
+
+	hl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating HTTP listener: %s", err)
+	}
+
+	defer hl.Close()
+
+	var files []*os.File
+
+	for _, s := range [...]interface{ File() (*os.File, error) }{tl, ul, uc, hl} {
+		f, err := s.File()
+		if err != nil {
+			t.Fatalf("unexpected error getting socket file: %s", err)
+		}
+
+		defer f.Close()
+
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdSocketsProcess$") //nolint:gosec
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), "TEST_SYSTEMD_SOCKETS=1", "LISTEN_FDS=4", "LISTEN_FDNAMES=tcp:unix:udp:"+fdNameHTTP)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("unexpected error running process: %s\n%s", err, out)
+	}
+
+	expected := fmt.Sprintf("stream tcp %s\nstream unix %s\nudp udp %s\nhttp tcp %s\nenv \n",
+		tl.Addr(), ul.Addr(), uc.LocalAddr(), hl.Addr())
+
+	if !strings.Contains(string(out), expected) {
+		t.Errorf("expecting process to output %q, got %q", expected, out)
+	}
+}
+
+// TestSystemdSocketsProcess is run by TestSystemdSockets in a child process,
+// to which it passes sockets as systemd would.
+func TestSystemdSocketsProcess(t *testing.T) {
+	if os.Getenv("TEST_SYSTEMD_SOCKETS") != "1" {
+		t.Skip("only run by TestSystemdSockets")
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid())) //nolint:errcheck
+
+	s, err := systemdSockets(func(l net.Listener) net.Listener { return l })
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if s == nil {
+		t.Fatalf("expecting sockets, got nil")
+	}
+
+	for _, l := range s.Stream {
+		fmt.Printf("stream %s %s\n", l.Addr().Network(), l.Addr())
+	}
+
+	for _, uc := range s.UDP {
+		fmt.Printf("udp %s %s\n", uc.LocalAddr().Network(), uc.LocalAddr())
+	}
+
+	if s.HTTP != nil {
+		fmt.Printf("http %s %s\n", s.HTTP.Addr().Network(), s.HTTP.Addr())
+	}
+
+	fmt.Printf("env %s\n", os.Getenv("LISTEN_PID")+os.Getenv("LISTEN_FDS")+os.Getenv("LISTEN_FDNAMES"))
+}
+
+func TestSystemdSocketsOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+
+	if s, err := systemdSockets(nil); err != nil || s != nil {
+		t.Errorf("expecting no sockets for another process, got %v, %v", s, err)
+	}
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("expecting LISTEN_FDS to be unset")
+	}
+}
+
+func TestSDNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("unexpected error with no notification socket: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify")
+
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unexpected error creating notification socket: %s", err)
+	}
+
+	defer c.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	for _, state := range [...]string{"READY=1", "STOPPING=1"} {
+		if err := sdNotify(state); err != nil {
+			t.Fatalf("unexpected error notifying: %s", err)
+		}
+
+		buf := make([]byte, 64)
+
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("unexpected error reading notification: %s", err)
+		} else if string(buf[:n]) != state {
+			t.Errorf("expecting notification %q, got %q", state, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCert(t, dir, "ca", nil, nil)
+	newTestCert(t, dir, "server", ca, caKey)
+
+	for n, test := range [...]struct {
+		Cert, Key, CA string
+		Nil, Error    bool
+	}{
+		{Nil: true},
+		{Cert: "server.crt", Key: "server.key"},
+		{Cert: "server.crt", Key: "server.key", CA: "ca.crt"},
+		{Cert: "server.crt", Error: true},
+		{CA: "ca.crt", Error: true},
+		{Cert: "server.crt", Key: "server.key", CA: "server.key", Error: true},
+		{Cert: "missing.crt", Key: "server.key", Error: true},
+	} {
+		config, err := newTLSConfig(testPath(dir, test.Cert), testPath(dir, test.Key), testPath(dir, test.CA))
+		if test.Error {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if (config == nil) != test.Nil {
+			t.Errorf("test %d: expecting nil config to be %v, got %v", n+1, test.Nil, config == nil)
+		} else if config != nil && (config.ClientCAs != nil) != (test.CA != "") {
+			t.Errorf("test %d: expecting client certificate verification to be %v", n+1, test.CA != "")
+		}
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCert(t, dir, "ca", nil, nil)
+	newTestCert(t, dir, "server", ca, caKey)
+	newTestCert(t, dir, "client", ca, caKey)
+
+	config, err := newTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("unexpected error creating TLS config: %s", err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	go newAnalyticsServer(tls.NewListener(l, config), newIngester(db, rules, newMetrics(db), ingestConfig{}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatalf("unexpected error loading client certificate: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		Username     string
+		Certificates []tls.Certificate
+	}{
+		{"USER_A", []tls.Certificate{clientCert}},
+		{"USER_B", nil},
+	} {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: test.Certificates,
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			t.Fatalf("test %d: unexpected error opening connection: %s", n+1, err)
+		}
+
+		io.WriteString(c, test.Username+"\x00/path/to/command") //nolint:errcheck
+		c.CloseWrite()                                          //nolint:errcheck
+		io.Copy(io.Discard, c)                                  //nolint:errcheck
+		c.Close()
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	if out := dumpTable(t, db, "events"); !strings.HasPrefix(out, "USER_A,/path/to/command,127.0.0.1,") ||
+		strings.Contains(out, "USER_B") {
+		t.Errorf("expecting only USER_A event to be recorded, got %q", out)
+	}
+}
+
+func testPath(dir, name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return filepath.Join(dir, name)
+}
+
+// newTestCert creates a certificate and key, writing them as PEM to name.crt
+// and name.key in the given dir. When no parent is given, the certificate is a
+// self-signed CA.
+func newTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error marshalling key: %s", err)
+	}
+
+	for ext, block := range map[string]*pem.Block{
+		".crt": {Type: "CERTIFICATE", Bytes: der},
+		".key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name+ext), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("unexpected error writing %s%s: %s", name, ext, err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %s", err)
+	}
+
+	return cert, key
+}
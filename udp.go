@@ -0,0 +1,65 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"net"
+
+	"github.com/wtsi-hgi/go-softpack-analytics/analytics"
+)
+
+// maxPayloadSize is the largest payload accepted from a client.
+const maxPayloadSize = analytics.MaxPayloadSize
+
+// newUDPServer reads payloads, one per datagram, from the given connection until
+// it is closed.
+func newUDPServer(uc *net.UDPConn, in *ingester) error {
+	buf := make([]byte, maxPayloadSize+1)
+
+	for {
+		n, addr, err := uc.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		in.metrics.datagrams.Inc()
+
+		handleDatagram(buf[:n], addr, in)
+	}
+}
+
+func handleDatagram(data []byte, addr *net.UDPAddr, in *ingester) {
+	if in.access.allow(addr.IP.String()) != nil {
+		return
+	} else if len(data) > maxPayloadSize {
+		in.metrics.reject("too_large")
+
+		return
+	}
+
+	in.ingest(string(data), source{IP: addr.IP.String()})
+}
@@ -0,0 +1,97 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultUnixMode = "0666"
+
+	// unixSourcePrefix begins the source recorded, in place of an IP address,
+	// for events received over a Unix socket; it is followed by the UID of the
+	// sending process.
+	unixSourcePrefix = "unix:"
+)
+
+var (
+	ErrNoListener          = errors.New("no TCP port or Unix socket to listen on")
+	ErrNotSocket           = errors.New("path exists and is not a socket")
+	ErrPeerCredUnsupported = errors.New("peer credentials not supported on this platform")
+)
+
+// peerCred is the identity, as verified by the kernel, of the process at the
+// other end of a Unix socket.
+type peerCred struct {
+	UID uint32
+	PID int32
+}
+
+// listenUnix listens on a Unix socket at the given path, which is created with
+// the given octal permissions. A socket left at the path by a previous run is
+// removed.
+func listenUnix(path, mode string) (*net.UnixListener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %w", mode, err)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%w: %s", ErrNotSocket, path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, fs.FileMode(perm)); err != nil {
+		ul.Close()
+
+		return nil, err
+	}
+
+	return ul, nil
+}
+
+func isUnixConn(c net.Conn) bool {
+	_, ok := c.(*net.UnixConn)
+
+	return ok
+}
@@ -0,0 +1,171 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnixListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	path := filepath.Join(t.TempDir(), "analytics.sock")
+
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("unexpected error creating file: %s", err)
+	}
+
+	if _, err := listenUnix(path, defaultUnixMode); err == nil {
+		t.Fatalf("expecting error listening over a regular file")
+	}
+
+	os.Remove(path)
+
+	if _, err := listenUnix(path, "rw"); err == nil {
+		t.Fatalf("expecting error with invalid mode")
+	}
+
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("unexpected error creating stale socket: %s", err)
+	}
+
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ul, err := listenUnix(path, "0600")
+	if err != nil {
+		t.Fatalf("unexpected error listening on socket: %s", err)
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatalf("unexpected error checking socket: %s", err)
+	} else if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("expecting socket permissions 0600, got %o", perm)
+	}
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error creating database: %s", err)
+	}
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatalf("unexpected error loading rules: %s", err)
+	}
+
+	allow, err := parseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("unexpected error parsing CIDRs: %s", err)
+	}
+
+	in := newIngester(db, rules, newMetrics(db), ingestConfig{Access: accessConfig{Allow: allow}})
+
+	go serveListeners(in, ul) //nolint:errcheck
+
+	me, err := user.Current()
+	if err != nil {
+		t.Fatalf("unexpected error getting current user: %s", err)
+	}
+
+	for _, username := range [...]string{me.Username, "USER_B"} {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("unexpected error opening connection: %s", err)
+		}
+
+		io.WriteString(c, username+"\x00/path/to/command") //nolint:errcheck
+		c.Close()
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	ip := unixSourcePrefix + strconv.Itoa(os.Getuid())
+	out := dumpTable(t, db, "events")
+
+	for _, expected := range [...]string{
+		me.Username + ",/path/to/command," + ip + ",",
+		",," + me.Username + ",<nil>\n",
+		"USER_B,/path/to/command," + ip + ",",
+		"," + flagUserMismatch + "," + me.Username + ",<nil>\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expecting events table to contain %q, got %q", expected, out)
+		}
+	}
+}
+
+func TestUnixConnSource(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	ul, err := listenUnix(filepath.Join(t.TempDir(), "analytics.sock"), "0600")
+	if err != nil {
+		t.Fatalf("unexpected error listening on socket: %s", err)
+	}
+
+	defer ul.Close()
+
+	c, err := net.Dial("unix", ul.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error opening connection: %s", err)
+	}
+
+	defer c.Close()
+
+	sc, err := ul.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error accepting connection: %s", err)
+	}
+
+	defer sc.Close()
+
+	src, err := connSource(sc, 0)
+	if err != nil {
+		t.Fatalf("unexpected error getting source: %s", err)
+	}
+
+	if ip := unixSourcePrefix + strconv.Itoa(os.Getuid()); src.IP != ip {
+		t.Errorf("expecting source %q, got %q", ip, src.IP)
+	}
+
+	if src.PID != int32(os.Getpid()) {
+		t.Errorf("expecting PID %d, got %d", os.Getpid(), src.PID)
+	}
+}
@@ -0,0 +1,120 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Authors:
+ *	- Michael Woolnough <mw31@sanger.ac.uk>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	ErrDrift        = errors.New("module tables differ from events")
+	ErrUnclassified = errors.New("database contains unclassified events; run reclassify first")
+)
+
+func runVerify(args []string) error {
+	flags := newFlagSet("verify", "", "Checks that the module tables of the database match its events.")
+	output := flags.String("d", "", "db file")
+	rulesFile := flags.String("r", "", "classification rules file")
+	repair := flags.Bool("repair", false, "rebuild any module tables that differ from the events")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return ErrNoDatabase
+	}
+
+	rules, err := LoadRules(*rulesFile)
+	if err != nil {
+		return fmt.Errorf("error loading rules: %w", err)
+	}
+
+	db, err := NewDB(*output, rules.Categories()...)
+	if err != nil {
+		return fmt.Errorf("error opening database (%s): %w", *output, err)
+	}
+
+	defer db.Close()
+
+	drifts, unclassified, err := db.Verify()
+	if err != nil {
+		return fmt.Errorf("error verifying database: %w", err)
+	}
+
+	return reportDrift(db, drifts, unclassified, *repair)
+}
+
+func reportDrift(db *DB, drifts []Drift, unclassified int64, repair bool) error {
+	if unclassified > 0 {
+		slog.Warn("unclassified events cannot be verified", "count", unclassified)
+	}
+
+	categories := make(map[string]bool)
+
+	var order []string
+
+	for _, drift := range drifts {
+		fmt.Printf("%s\t%s\t%s\texpected %s\tgot %s\n", drift.Category, drift.Module, drift.Username,
+			formatUsage(drift.Expected), formatUsage(drift.Actual))
+
+		if !categories[drift.Category] {
+			categories[drift.Category] = true
+			order = append(order, drift.Category)
+		}
+	}
+
+	if len(drifts) == 0 {
+		slog.Info("No drift found")
+
+		return nil
+	} else if !repair {
+		return fmt.Errorf("%w: %d rows", ErrDrift, len(drifts))
+	} else if unclassified > 0 {
+		return ErrUnclassified
+	}
+
+	slog.Info("Repairing…", "categories", order)
+
+	if err := db.Repair(order...); err != nil {
+		return fmt.Errorf("error repairing database: %w", err)
+	}
+
+	slog.Info("…Done")
+
+	return nil
+}
+
+func formatUsage(u *Usage) string {
+	if u == nil {
+		return "nothing"
+	}
+
+	return fmt.Sprintf("count=%d firstuse=%d lastuse=%d", u.Count, u.FirstUse, u.LastUse)
+}